@@ -3,8 +3,9 @@ package kademlia
 import (
 	"bytes"
 	"crypto/rand"
+	"encoding/hex"
+	"fmt"
 	"log"
-  "fmt"
 )
 
 // A struct used to verify message integrity in RPC responses, since ports can be re-used.
@@ -25,10 +26,25 @@ func GenerateRandomAuthID() *AuthID {
 		log.Fatal(err)
 	}
 	var d [20]byte
-	copy(rnd[:], d[:20])
+	copy(d[:], rnd[:20])
 	return &AuthID{d}
 }
 
+// Parse an id from its hex string representation (see String).
+// Returns an error unless s is exactly 20 hex encoded bytes.
+func ParseAuthID(s string) (*AuthID, error) {
+	var d [20]byte
+	decoded, err := hex.DecodeString(s)
+	if err != nil {
+		return nil, fmt.Errorf("invalid auth id: %w", err)
+	}
+	if len(decoded) != len(d) {
+		return nil, fmt.Errorf("invalid auth id: %d bytes, expected %d", len(decoded), len(d))
+	}
+	copy(d[:], decoded)
+	return &AuthID{d}, nil
+}
+
 // Compare two ids for equality.
 func (auth_id *AuthID) Equals(a AuthID) bool {
 	return bytes.Equal(auth_id.value[:], a.value[:])
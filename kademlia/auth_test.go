@@ -70,3 +70,17 @@ func TestString(t *testing.T) {
 		t.Error("String does not return correct result")
 	}
 }
+
+func TestParseAuthID(t *testing.T) {
+	a1 := GenerateRandomAuthID()
+	a2, err := ParseAuthID(a1.String())
+	if err != nil || !a1.Equals(*a2) {
+		t.Errorf("Parsed id %v does not match %s (%v)", a2, a1.String(), err)
+	}
+
+	for _, invalid := range []string{"", "zz34567890abcdef1234567890abcdef12345678", "1234", "1234567890abcdef1234567890abcdef1234567890"} {
+		if _, err := ParseAuthID(invalid); err == nil {
+			t.Errorf("Expected an error for %q", invalid)
+		}
+	}
+}
@@ -2,24 +2,54 @@ package kademlia
 
 import (
 	"container/list"
+	"sync"
+	"time"
 )
 
 // bucket definition
-// contains a List
+// contains a List, a replacement cache of contacts that did not fit in the List,
+// a count of failed RPCs in a row per contact in the List, and the time of the last lookup in its range.
+// All of it is guarded by lock so that a bucket is safe for concurrent use
 type bucket struct {
-	list *list.List
+	list         *list.List
+	replacements *list.List
+	failures     map[KademliaID]int
+	last_lookup  time.Time
+	lock         sync.RWMutex
 }
 
 // newBucket returns a new instance of a bucket
 func newBucket() *bucket {
 	bucket := &bucket{}
 	bucket.list = list.New()
+	bucket.replacements = list.New()
+	bucket.failures = make(map[KademliaID]int)
+	bucket.last_lookup = time.Now()
 	return bucket
 }
 
+// Touch records that a lookup in the range of the bucket has been done
+func (bucket *bucket) Touch() {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+	bucket.last_lookup = time.Now()
+}
+
+// LastLookup returns the time of the last lookup in the range of the bucket
+func (bucket *bucket) LastLookup() time.Time {
+	bucket.lock.RLock()
+	defer bucket.lock.RUnlock()
+	return bucket.last_lookup
+}
+
 // AddContact adds the Contact to the front of the bucket
-// or moves it to the front of the bucket if it already existed
-func (bucket *bucket) AddContact(contact Contact) {
+// or moves it to the front of the bucket if it already existed, updating it if the contact was heard from directly.
+// If the bucket is full the contact is put in the replacement cache instead, and the
+// least-recently seen contact at the back of the bucket is returned so that it can be checked for liveness.
+func (bucket *bucket) AddContact(contact Contact) *Contact {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
 	var element *list.Element
 	for e := bucket.list.Front(); e != nil; e = e.Next() {
 		nodeID := e.Value.(Contact).ID
@@ -32,15 +62,102 @@ func (bucket *bucket) AddContact(contact Contact) {
 	if element == nil {
 		if bucket.list.Len() < bucketSize {
 			bucket.list.PushFront(contact)
+		} else {
+			bucket.addReplacement(contact)
+			lru := bucket.list.Back().Value.(Contact)
+			return &lru
 		}
 	} else {
+		// A contact learned second hand, e.g. from a lookup, does not overwrite what the contact told us itself
+		if contact.Version != VERSION_UNKNOWN {
+			element.Value = contact
+		}
 		bucket.list.MoveToFront(element)
+		delete(bucket.failures, *contact.ID)
+	}
+	return nil
+}
+
+// addReplacement adds the Contact to the front of the replacement cache,
+// dropping the oldest replacement if the cache is full. Must hold lock
+func (bucket *bucket) addReplacement(contact Contact) {
+	for e := bucket.replacements.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).ID.Equals(contact.ID) {
+			bucket.replacements.Remove(e)
+			break
+		}
+	}
+	bucket.replacements.PushFront(contact)
+	if bucket.replacements.Len() > replacementCacheSize {
+		bucket.replacements.Remove(bucket.replacements.Back())
+	}
+}
+
+// remove removes the Contact with the given id from the bucket and promotes
+// the freshest replacement in its place. Must hold lock
+func (bucket *bucket) remove(id *KademliaID) bool {
+	for e := bucket.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).ID.Equals(id) {
+			bucket.list.Remove(e)
+			delete(bucket.failures, *id)
+			if fresh := bucket.replacements.Front(); fresh != nil {
+				bucket.replacements.Remove(fresh)
+				bucket.list.PushFront(fresh.Value.(Contact))
+			}
+			return true
+		}
 	}
+	return false
 }
 
-// GetContactAndCalcDistance returns an array of Contacts where 
+// RemoveContact removes the Contact with the given id from the bucket,
+// promoting the freshest replacement. Returns false if it was not in the bucket
+func (bucket *bucket) RemoveContact(id *KademliaID) bool {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	return bucket.remove(id)
+}
+
+// MarkFailed counts a failed RPC to the Contact with the given id.
+// After staleFailures failures in a row the contact is stale, and is replaced
+// if the replacement cache has a contact to promote; otherwise it stays flagged.
+// Returns true if the contact was removed
+func (bucket *bucket) MarkFailed(id *KademliaID) bool {
+	bucket.lock.Lock()
+	defer bucket.lock.Unlock()
+
+	found := false
+	for e := bucket.list.Front(); e != nil; e = e.Next() {
+		if e.Value.(Contact).ID.Equals(id) {
+			found = true
+			break
+		}
+	}
+	if !found {
+		return false
+	}
+
+	bucket.failures[*id]++
+	if bucket.failures[*id] < staleFailures || bucket.replacements.Len() == 0 {
+		return false
+	}
+	return bucket.remove(id)
+}
+
+// ReplacementLen returns the size of the replacement cache
+func (bucket *bucket) ReplacementLen() int {
+	bucket.lock.RLock()
+	defer bucket.lock.RUnlock()
+	return bucket.replacements.Len()
+}
+
+// GetContactAndCalcDistance returns an array of Contacts where
 // the distance has already been calculated
 func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
+	bucket.lock.RLock()
+	defer bucket.lock.RUnlock()
+
 	var contacts []Contact
 
 	for elt := bucket.list.Front(); elt != nil; elt = elt.Next() {
@@ -54,5 +171,7 @@ func (bucket *bucket) GetContactAndCalcDistance(target *KademliaID) []Contact {
 
 // Len return the size of the bucket
 func (bucket *bucket) Len() int {
+	bucket.lock.RLock()
+	defer bucket.lock.RUnlock()
 	return bucket.list.Len()
 }
@@ -1 +1,81 @@
 package kademlia
+
+import (
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Returns a random id whose first bit is 0, so that all of them share a bucket
+// in a routing table whose own id starts with a 1 bit.
+func newFarKademliaID() *KademliaID {
+	id := NewRandomKademliaID()
+	id[0] &= 0x7F
+	return id
+}
+
+// TestBucketFullReturnsLRU verifies that a full bucket rejects a new contact and returns the least-recently seen one.
+func TestBucketFullReturnsLRU(t *testing.T) {
+	b := newBucket()
+	var first Contact
+	for i := 0; i < bucketSize; i++ {
+		c := NewContact(newFarKademliaID(), "localhost:8000")
+		if i == 0 {
+			first = c
+		}
+		assert.Nil(t, b.AddContact(c), "Expected contact to fit in the bucket")
+	}
+
+	lru := b.AddContact(NewContact(newFarKademliaID(), "localhost:8001"))
+	assert.NotNil(t, lru, "Expected a full bucket to return its least-recently seen contact")
+	assert.True(t, lru.ID.Equals(first.ID))
+	assert.Equal(t, bucketSize, b.Len())
+
+	// Seeing the first contact again moves it to the front
+	assert.Nil(t, b.AddContact(first))
+	lru = b.AddContact(NewContact(newFarKademliaID(), "localhost:8001"))
+	assert.False(t, lru.ID.Equals(first.ID))
+}
+
+// TestBucketReplacementCache verifies that contacts that do not fit are cached, bounded, and promoted on removal.
+func TestBucketReplacementCache(t *testing.T) {
+	b := newBucket()
+	for i := 0; i < bucketSize; i++ {
+		b.AddContact(NewContact(newFarKademliaID(), "localhost:8000"))
+	}
+	for i := 0; i < replacementCacheSize+5; i++ {
+		b.AddContact(NewContact(newFarKademliaID(), "localhost:8001"))
+	}
+	assert.Equal(t, replacementCacheSize, b.ReplacementLen(), "Expected the replacement cache to be bounded")
+
+	fresh := NewContact(newFarKademliaID(), "localhost:8002")
+	lru := b.AddContact(fresh)
+	assert.True(t, b.RemoveContact(lru.ID))
+	assert.Equal(t, bucketSize, b.Len(), "Expected a replacement to be promoted")
+	assert.Nil(t, b.AddContact(fresh), "Expected the freshest replacement to be in the bucket")
+	assert.Equal(t, replacementCacheSize-1, b.ReplacementLen())
+}
+
+// TestBucketMarkFailed verifies that a contact is only replaced once stale and a replacement exists.
+func TestBucketMarkFailed(t *testing.T) {
+	b := newBucket()
+	c := NewContact(newFarKademliaID(), "localhost:8000")
+	b.AddContact(c)
+
+	for i := 0; i < staleFailures; i++ {
+		assert.False(t, b.MarkFailed(c.ID), "Expected stale contact to be kept without replacements")
+	}
+
+	b.addReplacement(NewContact(newFarKademliaID(), "localhost:8001"))
+	assert.True(t, b.MarkFailed(c.ID), "Expected stale contact to be replaced")
+	assert.Equal(t, 1, b.Len())
+	assert.Equal(t, 0, b.ReplacementLen())
+
+	// Seeing a contact again resets its failures
+	d := NewContact(newFarKademliaID(), "localhost:8002")
+	b.AddContact(d)
+	b.addReplacement(NewContact(newFarKademliaID(), "localhost:8003"))
+	b.MarkFailed(d.ID)
+	b.AddContact(d)
+	assert.False(t, b.MarkFailed(d.ID))
+}
@@ -0,0 +1,216 @@
+package kademlia
+
+// This file contains the storing of values that do not fit in one datagram.
+// Such a value is split into chunks of CHUNK_SIZE bytes, each stored under the hash of its
+// content (see GetDataID), and the key of the value holds a manifest listing the chunks:
+//
+//	size  field
+//	10    manifestMagic
+//	1     depth of the chunk tree
+//	8     size of the value
+//	20*n  keys of the top level chunks, at most (CHUNK_SIZE-19)/20
+//
+// With a depth of 0 the chunks hold the value, otherwise every chunk holds the keys of up to
+// CHUNK_SIZE/20 chunks one level down, so that a value of many megabytes still has a small manifest.
+// Values that start with manifestMagic are chunked however small they are, so a manifest is never ambiguous.
+// The depth and the number of keys at every level follow from the size (see chunkLevels), so a manifest
+// that does not match its size is rejected before any chunk is fetched.
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"sync"
+	"time"
+)
+
+const CHUNK_SIZE = 1024         // Largest value stored as is, and the size of every chunk of a larger value
+const MAX_CHUNK_DEPTH = 3       // Levels of chunks of keys below a manifest, see above
+const CHUNK_PARALLELISM = 8     // Chunks stored or fetched at the same time
+const MAX_VALUE_SIZE = 64 << 20 // Largest value that is stored or fetched as chunks
+const manifestMagic = "\x00manifest\x00"
+const manifestHeaderSize = len(manifestMagic) + 1 + 8
+const manifestFanout = (CHUNK_SIZE - manifestHeaderSize) / IDLength // Keys in a manifest
+const chunkFanout = CHUNK_SIZE / IDLength                           // Keys in a chunk of keys
+
+var (
+	ErrValueTooLarge = errors.New("value too large")
+	ErrBadManifest   = errors.New("malformed manifest")
+)
+
+// Returns true if value is too large to be stored as is, or could be mistaken for a manifest.
+func needsChunking(value []byte) bool {
+	return len(value) > CHUNK_SIZE || IsManifest(value)
+}
+
+// Returns true if value is the manifest of a chunked value.
+func IsManifest(value []byte) bool {
+	return bytes.HasPrefix(value, []byte(manifestMagic))
+}
+
+// Split data into pieces of at most size bytes.
+func splitChunks(data []byte, size int) [][]byte {
+	var chunks [][]byte
+	for len(data) > size {
+		chunks = append(chunks, data[:size])
+		data = data[size:]
+	}
+	return append(chunks, data)
+}
+
+// Returns the number of chunks at every level of the chunk tree of a value of size bytes,
+// from the chunks holding the value up to the keys listed in the manifest; the depth is one less than the number of levels.
+func chunkLevels(size uint64) ([]int, error) {
+	if size > MAX_VALUE_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes", ErrValueTooLarge, size)
+	}
+	n := max(int((size+CHUNK_SIZE-1)/CHUNK_SIZE), 1)
+	levels := []int{n}
+	for n > manifestFanout {
+		if len(levels) > MAX_CHUNK_DEPTH {
+			return nil, fmt.Errorf("%w: %d bytes", ErrValueTooLarge, size)
+		}
+		n = (n + chunkFanout - 1) / chunkFanout
+		levels = append(levels, n)
+	}
+	return levels, nil
+}
+
+// Store value as chunks with a manifest under key, see above.
+// The manifest and every chunk are republished like any other value put by this node.
+// Returns the result of storing the manifest, once all chunks have been stored.
+func (network *Network) putChunked(ctx context.Context, key *KademliaID, value []byte, ttl time.Duration) (StoreResult, error) {
+	levels, err := chunkLevels(uint64(len(value)))
+	if err != nil {
+		return StoreResult{Key: key}, err
+	}
+	keys, err := network.putChunks(ctx, splitChunks(value, CHUNK_SIZE), ttl)
+	depth := 0
+	for err == nil && depth < len(levels)-1 {
+		keys, err = network.putChunks(ctx, splitChunks(bytes.Join(keys, nil), chunkFanout*IDLength), ttl)
+		depth++
+	}
+	if err != nil {
+		return StoreResult{Key: key}, err
+	}
+
+	manifest := make([]byte, 0, manifestHeaderSize+len(keys)*IDLength)
+	manifest = append(manifest, manifestMagic...)
+	manifest = append(manifest, byte(depth))
+	manifest = binary.BigEndian.AppendUint64(manifest, uint64(len(value)))
+	manifest = append(manifest, bytes.Join(keys, nil)...)
+	fmt.Printf("Storing %d bytes under %s as chunks, depth %d\n", len(value), key.String(), depth)
+	network.publish(key, manifest, ttl)
+	return network.storeValue(ctx, key, manifest, ttl)
+}
+
+// Store every chunk under its hash, CHUNK_PARALLELISM at a time.
+// Returns the keys of the chunks in order, or the first error.
+func (network *Network) putChunks(ctx context.Context, chunks [][]byte, ttl time.Duration) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	keys := make([][]byte, len(chunks))
+	errs := make(chan error, len(chunks))
+	sem := make(chan struct{}, CHUNK_PARALLELISM)
+	var wg sync.WaitGroup
+	for i, chunk := range chunks {
+		key := GetDataID(chunk)
+		keys[i] = key[:]
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(key *KademliaID, chunk []byte) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			network.publish(key, chunk, ttl)
+			if _, err := network.storeValue(ctx, key, chunk, ttl); err != nil {
+				errs <- fmt.Errorf("chunk %s: %w", key.String(), err)
+				cancel()
+			}
+		}(key, chunk)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return keys, nil
+}
+
+// Returns the value a manifest refers to, fetching its chunks from the network.
+// The depth and number of keys of the manifest, and of every level of chunks fetched, must match its size.
+// Any other value is returned as is.
+func (network *Network) resolveValue(ctx context.Context, value []byte) ([]byte, error) {
+	if !IsManifest(value) {
+		return value, nil
+	}
+	if len(value) <= manifestHeaderSize || (len(value)-manifestHeaderSize)%IDLength != 0 {
+		return nil, ErrBadManifest
+	}
+	depth := int(value[len(manifestMagic)])
+	size := binary.BigEndian.Uint64(value[len(manifestMagic)+1:])
+	levels, err := chunkLevels(size)
+	if err != nil {
+		return nil, err
+	}
+	keys := splitChunks(value[manifestHeaderSize:], IDLength)
+	if depth != len(levels)-1 || len(keys) != levels[depth] {
+		return nil, fmt.Errorf("%w: depth %d with %d keys for %d bytes", ErrBadManifest, depth, len(keys), size)
+	}
+
+	for ; depth >= 0; depth-- {
+		chunks, err := network.getChunks(ctx, keys)
+		if err != nil {
+			return nil, err
+		}
+		data := bytes.Join(chunks, nil)
+		if depth == 0 {
+			if uint64(len(data)) != size {
+				return nil, fmt.Errorf("%w: %d bytes, expected %d", ErrBadManifest, len(data), size)
+			}
+			return data, nil
+		}
+		if len(data) != levels[depth-1]*IDLength {
+			return nil, fmt.Errorf("%w: %d bytes of keys at depth %d, expected %d keys", ErrBadManifest, len(data), depth, levels[depth-1])
+		}
+		keys = splitChunks(data, IDLength)
+	}
+	return nil, ErrBadManifest
+}
+
+// Fetch the chunks stored under keys, CHUNK_PARALLELISM at a time, checking each against its key (see FindContent).
+// Returns the chunks in order, or the first error.
+func (network *Network) getChunks(ctx context.Context, keys [][]byte) ([][]byte, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	chunks := make([][]byte, len(keys))
+	errs := make(chan error, len(keys))
+	sem := make(chan struct{}, CHUNK_PARALLELISM)
+	var wg sync.WaitGroup
+	for i, raw := range keys {
+		var key KademliaID
+		copy(key[:], raw)
+		wg.Add(1)
+		sem <- struct{}{}
+		go func(i int, key *KademliaID) {
+			defer wg.Done()
+			defer func() { <-sem }()
+			result, err := network.FindContent(ctx, key)
+			if err != nil {
+				errs <- fmt.Errorf("chunk %s: %w", key.String(), err)
+				cancel()
+				return
+			}
+			chunks[i] = result.Value
+		}(i, &key)
+	}
+	wg.Wait()
+	close(errs)
+	if err := <-errs; err != nil {
+		return nil, err
+	}
+	return chunks, nil
+}
@@ -0,0 +1,98 @@
+package kademlia
+
+import (
+	"bytes"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"math"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestChunkFits verifies that a STORE of a full chunk fits in one datagram in every protocol version.
+func TestChunkFits(t *testing.T) {
+	key := GenerateNodeKey()
+	params := byte_arr_list{[]byte(NewRandomKademliaID().String()), make([]byte, CHUNK_SIZE), EncodeTTL(MAX_VALUE_TTL)}
+	for version := MIN_PROTOCOL_VERSION; version <= PROTOCOL_VERSION; version++ {
+		msg := NewNetworkMessage(RPC_STORE, NewRandomKademliaID(), 65535, GenerateRandomAuthID(), params)
+		msg.Version = version
+		assert.NoError(t, msg.Sign(key))
+		_, err := msg.MarshalBinary()
+		assert.NoError(t, err, "Version %d", version)
+	}
+}
+
+// TestPutChunked verifies that values larger than a chunk, or that look like a manifest, are stored as chunks and read back whole.
+func TestPutChunked(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19220", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19221", NewMemoryStore())
+	n3 := NewNetwork("127.0.0.1", "19222", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	go n3.Listen()
+	n1.routing_table.AddContact(n2.routing_table.me)
+	n1.routing_table.AddContact(n3.routing_table.me)
+	n3.routing_table.AddContact(n2.routing_table.me)
+
+	var large bytes.Buffer
+	for i := 0; large.Len() < (manifestFanout+1)*CHUNK_SIZE; i++ {
+		fmt.Fprintf(&large, "line %d\n", i)
+	}
+	values := map[string][]byte{
+		"large":     large.Bytes(),
+		"small":     []byte("small"),
+		"lookalike": []byte(manifestMagic + "not a manifest"),
+	}
+	for name, value := range values {
+		key := GetValueID(name)
+		_, err := n1.Put(context.Background(), key, value)
+		assert.NoError(t, err, name)
+		stored, _ := n2.data_store.GetEntry(key)
+		assert.Equal(t, name == "small", !IsManifest(stored), name)
+
+		got, _, err := n3.Get(context.Background(), key)
+		assert.NoError(t, err, name)
+		assert.Equal(t, value, got, name)
+	}
+}
+
+// TestBadChunk verifies that a chunk that does not match its key is rejected.
+func TestBadChunk(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19223", NewMemoryStore())
+	chunk := GetValueID("chunk")
+	network.data_store.Store(chunk, []byte("not the chunk"))
+
+	manifest := append([]byte(manifestMagic), 0, 0, 0, 0, 0, 0, 0, 0, 13)
+	manifest = append(manifest, chunk[:]...)
+	_, err := network.resolveValue(context.Background(), manifest)
+	assert.ErrorIs(t, err, ErrTamperedValue)
+	_, err = network.resolveValue(context.Background(), manifest[:len(manifest)-1])
+	assert.ErrorIs(t, err, ErrBadManifest)
+}
+
+// TestManifestLimits verifies that a manifest whose depth, keys or size do not add up is rejected before any chunk is fetched.
+func TestManifestLimits(t *testing.T) {
+	levels, err := chunkLevels(uint64((manifestFanout + 1) * CHUNK_SIZE))
+	assert.NoError(t, err)
+	assert.Equal(t, []int{manifestFanout + 1, 1}, levels)
+	_, err = chunkLevels(MAX_VALUE_SIZE + 1)
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+
+	// Nothing is stored and the node knows no contacts, so fetching any chunk would fail with ErrNoContacts
+	network := NewNetwork("127.0.0.1", "19224", NewMemoryStore())
+	manifest := func(depth byte, size uint64, keys int) []byte {
+		m := append([]byte(manifestMagic), depth)
+		m = binary.BigEndian.AppendUint64(m, size)
+		return append(m, make([]byte, keys*IDLength)...)
+	}
+	_, err = network.resolveValue(context.Background(), manifest(MAX_CHUNK_DEPTH, 13, manifestFanout))
+	assert.ErrorIs(t, err, ErrBadManifest)
+	_, err = network.resolveValue(context.Background(), manifest(0, 13, 2))
+	assert.ErrorIs(t, err, ErrBadManifest)
+	_, err = network.resolveValue(context.Background(), manifest(MAX_CHUNK_DEPTH, math.MaxUint64, manifestFanout))
+	assert.ErrorIs(t, err, ErrValueTooLarge)
+	_, err = network.resolveValue(context.Background(), manifest(0, 13, 1))
+	assert.ErrorIs(t, err, ErrNoContacts)
+}
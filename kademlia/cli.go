@@ -2,12 +2,27 @@ package kademlia
 
 import (
 	"bufio"
+	"encoding/base64"
 	"fmt"
 	"os"
 	"strings"
 	"syscall"
 )
 
+// Number of arguments and usage of the CLI commands that take arguments
+var cliUsage = map[string]struct {
+	args  int
+	usage string
+}{
+	"put":        {2, "put <name> <value>"},
+	"put_file":   {2, "put_file <name> <path>"},
+	"put_base64": {2, "put_base64 <name> <base64 value>"},
+	"get":        {1, "get <name>"},
+	"get_file":   {2, "get_file <name> <path>"},
+	"get_base64": {1, "get_base64 <name>"},
+	"ping":       {1, "ping <node id>"},
+}
+
 func (network *Network) InitializeCLI() {
 	pipe_path := "/tmp/kademlia_pipe"
 	resp_path := "/tmp/kademlia_resp"
@@ -29,17 +44,51 @@ func (network *Network) InitializeCLI() {
 			continue
 		}
 		cmd := strings.SplitN(line, " ", 3)
+		if usage, ok := cliUsage[cmd[0]]; ok && len(cmd) <= usage.args {
+			fresp.WriteString("ERR: usage: " + usage.usage + "\n")
+			continue
+		}
 		switch cmd[0] {
 		case "put":
 			id := GetValueID(cmd[1])
 			status := network.SendStore(id.String(), []byte(cmd[2]))
 			fresp.WriteString(status)
 
+		case "put_file":
+			id := GetValueID(cmd[1])
+			value, err := os.ReadFile(cmd[2])
+			if err != nil {
+				fresp.WriteString(fmt.Sprintf("ERR: %v\n", err))
+				continue
+			}
+			status := network.SendStore(id.String(), value)
+			fresp.WriteString(status)
+
+		case "put_base64":
+			id := GetValueID(cmd[1])
+			value, err := base64.StdEncoding.DecodeString(cmd[2])
+			if err != nil {
+				fresp.WriteString(fmt.Sprintf("ERR: %v\n", err))
+				continue
+			}
+			status := network.SendStore(id.String(), value)
+			fresp.WriteString(status)
+
 		case "get":
 			id := GetValueID(cmd[1])
 			status := network.SendFindValue(id.String())
 			fresp.WriteString(status)
 
+		case "get_file":
+			id := GetValueID(cmd[1])
+			status := network.SendFindValueToFile(id.String(), cmd[2])
+			fresp.WriteString(status)
+
+		case "get_base64":
+			id := GetValueID(cmd[1])
+			status := network.SendFindValueBase64(id.String())
+			fresp.WriteString(status)
+
 		case "exit":
 			fresp.WriteString("Exiting...\n")
 			os.Exit(0)
@@ -0,0 +1,205 @@
+package kademlia
+
+// This file contains the typed client API of a node.
+// Every call respects the deadline and cancellation of its context;
+// the string based Send* functions in network.go wrap these for the CLI.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"time"
+)
+
+var (
+	ErrNoContacts    = errors.New("no closest node found")
+	ErrPingFailed    = errors.New("ping failed")
+	ErrValueNotFound = errors.New("value not found")
+	ErrStoreFailed   = errors.New("no node acknowledged the store")
+	ErrTamperedValue = errors.New("value does not match its key")
+
+	ErrQuorumNotReached = errors.New("store quorum not reached")
+
+	ErrBootstrapUnreachable = errors.New("bootstrap node unreachable")
+	ErrBootstrapIsSelf      = errors.New("bootstrap node is this node")
+)
+
+// Result of a Put
+type StoreResult struct {
+	Key      *KademliaID
+	Exists   bool      // The value was already stored at every node that acknowledged the store
+	Targets  int       // Number of closest nodes the value was sent to
+	Replicas int       // Number of nodes that acknowledged the store before it returned
+	Nodes    []Contact // Nodes that hold the value
+}
+
+// Ping the node with the given id, routed through the closest known contact.
+// Returns nil if the target answered.
+func (network *Network) Ping(ctx context.Context, target *KademliaID) error {
+	if network.routing_table.me.ID.Equals(target) {
+		fmt.Println("Ping is this node")
+		return nil
+	}
+
+	closest_contacts := network.routing_table.FindClosestContacts(target, 1)
+	if len(closest_contacts) == 0 {
+		return ErrNoContacts
+	}
+
+	closest_node := closest_contacts[0]
+	var params = make(byte_arr_list, 1)
+	params[0] = []byte(target.String())
+	resp, err := network.SendAndWaitContext(ctx, closest_node.Address, RPC_PING, params, network.rpc_opts)
+	if errors.Is(err, ErrRPCTimeout) {
+		network.MarkUnresponsive(closest_node)
+	}
+	if err != nil {
+		return err
+	}
+
+	switch resp.Rpc {
+	case RESP_PING_OK:
+		return nil
+	case RESP_PING_FAIL:
+		if len(resp.Data) == 0 {
+			return ErrPingFailed
+		}
+		return fmt.Errorf("%w: %s", ErrPingFailed, resp.Data[0])
+	default:
+		return fmt.Errorf("unexpected response %x to PING", resp.Rpc)
+	}
+}
+
+// Store a value under key at the nodes closest to it with the default TTL, see PutWithTTL.
+func (network *Network) Put(ctx context.Context, key *KademliaID, value []byte) (StoreResult, error) {
+	return network.PutWithTTL(ctx, key, value, DEFAULT_VALUE_TTL)
+}
+
+// Store a value under key at the nodes closest to it, found with an iterative node lookup.
+// The nodes remove the value once ttl has passed, unless this node republishes it before then (see republish.go).
+// Values larger than CHUNK_SIZE are stored as chunks, see chunk.go.
+func (network *Network) PutWithTTL(ctx context.Context, key *KademliaID, value []byte, ttl time.Duration) (StoreResult, error) {
+	if needsChunking(value) {
+		return network.putChunked(ctx, key, value, ttl)
+	}
+	network.publish(key, value, ttl)
+	return network.storeValue(ctx, key, value, ttl)
+}
+
+// Send STORE rpcs for the value to the k closest nodes to key and wait until the store quorum of nodes
+// (see SetStoreQuorum) holds the value, so that a node that died after the lookup does not hold up the store.
+// The other nodes are still sent the value, but their answers are not waited for.
+// Otherwise, once every node has answered, ErrQuorumNotReached or ErrStoreFailed is returned together with the
+// nodes that hold the value. If ctx ends first, the nodes that acknowledged the store so far are returned.
+func (network *Network) storeValue(ctx context.Context, key *KademliaID, value []byte, ttl time.Duration) (StoreResult, error) {
+	result := StoreResult{Key: key}
+	nodes, err := network.NodeLookup(ctx, key)
+	if err != nil {
+		return result, err
+	}
+	if len(nodes) == 0 {
+		return result, ErrNoContacts
+	}
+	result.Targets = len(nodes)
+
+	type storeReply struct {
+		node Contact
+		rpc  byte
+	}
+	ch := make(chan storeReply, len(nodes))
+	for _, n := range nodes {
+		go func(node Contact) {
+			params := storeParams(key, value, ttl, network.peerCaps(node.Address))
+			store_resp, err := network.SendAndWaitContext(ctx, node.Address, RPC_STORE, params, network.rpc_opts)
+			if err != nil {
+				if errors.Is(err, ErrRPCTimeout) {
+					network.MarkUnresponsive(node)
+				}
+				store_resp = NetworkMessage{Rpc: RESP_STORE_FAIL}
+			}
+			ch <- storeReply{node, store_resp.Rpc}
+		}(n)
+	}
+
+	quorum := network.store_quorum
+	if quorum > len(nodes) {
+		quorum = len(nodes)
+	}
+	// The value only counts as already existing if no node had to store it
+	stored := false
+	for range nodes {
+		select {
+		case reply := <-ch:
+			switch reply.rpc {
+			case RESP_STORE_OK:
+				stored = true
+			case RESP_STORE_EXISTS:
+			default:
+				continue
+			}
+			result.Replicas++
+			result.Nodes = append(result.Nodes, reply.node)
+		case <-ctx.Done():
+			result.Exists = result.Replicas > 0 && !stored
+			return result, ctx.Err()
+		}
+		if result.Replicas >= quorum {
+			break
+		}
+	}
+	result.Exists = result.Replicas > 0 && !stored
+
+	switch {
+	case result.Replicas == 0:
+		return result, ErrStoreFailed
+	case result.Replicas < quorum:
+		return result, fmt.Errorf("%w: %d of %d replicas", ErrQuorumNotReached, result.Replicas, quorum)
+	}
+	return result, nil
+}
+
+// The data fields of a STORE rpc for a node with the given capabilities; key, value and,
+// if the node has CAP_VALUE_TTL, ttl. Older nodes read another TTL format, and use their default without one.
+func storeParams(key *KademliaID, value []byte, ttl time.Duration, caps uint16) byte_arr_list {
+	params := byte_arr_list{[]byte(key.String()), value}
+	if caps&CAP_VALUE_TTL != 0 {
+		params = append(params, EncodeTTL(ttl))
+	}
+	return params
+}
+
+// Set the number of nodes that must acknowledge a store for it to succeed.
+// Stores to fewer nodes than the quorum, e.g. in a small network, only need all of them.
+func (network *Network) SetStoreQuorum(quorum int) {
+	if quorum < 1 {
+		quorum = 1
+	}
+	network.store_quorum = quorum
+}
+
+// Find the value stored under key with an iterative value lookup, see FindValue,
+// and fetch its chunks if it was stored as chunks.
+// If the value is not found, ErrValueNotFound is returned together with the closest contacts to key.
+func (network *Network) Get(ctx context.Context, key *KademliaID) ([]byte, []Contact, error) {
+	result, err := network.FindValue(ctx, key)
+	if err != nil {
+		return nil, result.Contacts, err
+	}
+	value, err := network.resolveValue(ctx, result.Value)
+	if err != nil {
+		return nil, result.Contacts, err
+	}
+	return value, result.Contacts, nil
+}
+
+// Find the k closest contacts to the given id with an iterative node lookup.
+func (network *Network) FindNode(ctx context.Context, target *KademliaID) ([]Contact, error) {
+	contacts, err := network.NodeLookup(ctx, target)
+	if err != nil {
+		return contacts, err
+	}
+	if len(contacts) == 0 {
+		return nil, ErrNoContacts
+	}
+	return contacts, nil
+}
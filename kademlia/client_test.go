@@ -0,0 +1,159 @@
+package kademlia
+
+import (
+	"context"
+	"errors"
+	"net"
+	"testing"
+	"time"
+)
+
+// TestPingSelf verifies that pinging the own id succeeds without any contacts.
+func TestPingSelf(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19110", NewMemoryStore())
+	if err := network.Ping(context.Background(), network.routing_table.me.ID); err != nil {
+		t.Errorf("Expected ping to self to succeed, got %v", err)
+	}
+}
+
+// TestPingNoContacts verifies that an empty routing table is reported as ErrNoContacts.
+func TestPingNoContacts(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19111", NewMemoryStore())
+	err := network.Ping(context.Background(), NewRandomKademliaID())
+	if !errors.Is(err, ErrNoContacts) {
+		t.Errorf("Expected ErrNoContacts, got %v", err)
+	}
+}
+
+// TestPingDeadline verifies that a context deadline ends a ping to a silent node early.
+func TestPingDeadline(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19112", NewMemoryStore())
+	go network.Listen()
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:19113")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	peer := NewContact(NewRandomKademliaID(), "127.0.0.1:19113")
+	network.routing_table.AddContact(peer)
+
+	ctx, cancel := context.WithTimeout(context.Background(), 100*time.Millisecond)
+	defer cancel()
+	start := time.Now()
+	err = network.Ping(ctx, peer.ID)
+	if !errors.Is(err, context.DeadlineExceeded) {
+		t.Errorf("Expected context.DeadlineExceeded, got %v", err)
+	}
+	if time.Since(start) >= RPC_TIMEOUT {
+		t.Error("Ping did not return at the context deadline")
+	}
+	if len(network.routing_table.FindClosestContacts(peer.ID, 1)) != 1 {
+		t.Error("Contact was dropped although it did not time out")
+	}
+}
+
+// TestPutReplicates verifies that a value is stored at every closest node and that the replicas are reported.
+func TestPutReplicates(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19180", NewMemoryStore())
+	peers := []*Network{
+		NewNetwork("127.0.0.1", "19181", NewMemoryStore()),
+		NewNetwork("127.0.0.1", "19182", NewMemoryStore()),
+		NewNetwork("127.0.0.1", "19183", NewMemoryStore()),
+	}
+	go n1.Listen()
+	for _, p := range peers {
+		go p.Listen()
+		n1.routing_table.AddContact(p.routing_table.me)
+	}
+
+	key := GetValueID("replicas")
+	res, err := n1.Put(context.Background(), key, []byte("replicas"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if res.Targets != 3 || res.Replicas != 3 || len(res.Nodes) != 3 {
+		t.Errorf("Expected 3 replicas at 3 targets, got %d at %d", res.Replicas, res.Targets)
+	}
+	for _, p := range peers {
+		if !p.data_store.EntryExists(key) {
+			t.Errorf("Value was not stored at %s", p.GetID())
+		}
+	}
+
+	res, err = n1.Put(context.Background(), key, []byte("replicas"))
+	if err != nil || !res.Exists || res.Replicas != 3 {
+		t.Errorf("Expected the value to exist at 3 replicas, got %d (%v)", res.Replicas, err)
+	}
+}
+
+// Returns a node that answers lookups but never stores.
+func newMuteNode(port string) *Network {
+	mute := NewNetwork("127.0.0.1", port, NewMemoryStore())
+	go func() {
+		buf := make([]byte, MAX_PACKET_SIZE)
+		for {
+			n, addr, err := mute.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg NetworkMessage
+			if msg.UnmarshalBinary(buf[:n]) == nil && msg.Rpc == RPC_FINDCONTACT {
+				aid, _ := ParseAuthID(msg.Aid)
+				mute.SendContacts(aid, addr.String(), nil)
+			}
+		}
+	}()
+	return mute
+}
+
+// TestPutQuorumNotReached verifies that a store fails if fewer nodes than the quorum acknowledge it.
+func TestPutQuorumNotReached(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19184", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19185", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	n1.rpc_opts = RPCOptions{Timeout: 50 * time.Millisecond, Retries: 0}
+	n1.routing_table.AddContact(n2.routing_table.me)
+
+	mute := newMuteNode("19186")
+	defer mute.conn.Close()
+	n1.routing_table.AddContact(mute.routing_table.me)
+
+	n1.SetStoreQuorum(2)
+	res, err := n1.Put(context.Background(), GetValueID("quorum"), []byte("quorum"))
+	if !errors.Is(err, ErrQuorumNotReached) {
+		t.Fatalf("Expected ErrQuorumNotReached, got %v", err)
+	}
+	if res.Replicas != 1 || !res.Nodes[0].ID.Equals(n2.routing_table.me.ID) {
+		t.Errorf("Expected n2 to be the only replica, got %d replicas", res.Replicas)
+	}
+
+	n1.SetStoreQuorum(1)
+	if _, err := n1.Put(context.Background(), GetValueID("quorum"), []byte("quorum")); err != nil {
+		t.Errorf("Expected a store with quorum 1 to succeed, got %v", err)
+	}
+}
+
+// TestPutReturnsAtQuorum verifies that a store returns once the quorum is reached, without waiting for a silent node.
+func TestPutReturnsAtQuorum(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19260", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19261", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	n1.rpc_opts = RPCOptions{Timeout: 2 * time.Second, Retries: 0}
+	n1.routing_table.AddContact(n2.routing_table.me)
+	mute := newMuteNode("19262")
+	defer mute.conn.Close()
+	n1.routing_table.AddContact(mute.routing_table.me)
+
+	n1.SetStoreQuorum(1)
+	start := time.Now()
+	res, err := n1.Put(context.Background(), GetValueID("early"), []byte("early"))
+	if err != nil || res.Replicas != 1 || res.Targets != 2 {
+		t.Fatalf("Expected 1 replica at 2 targets, got %d at %d (%v)", res.Replicas, res.Targets, err)
+	}
+	if elapsed := time.Since(start); elapsed > time.Second {
+		t.Errorf("Expected the store to return at quorum, took %v", elapsed)
+	}
+}
@@ -1,22 +1,28 @@
 package kademlia
 
 import (
-	"encoding/json"
+	"context"
+	"crypto/ed25519"
+	"encoding/binary"
+	"errors"
 	"fmt"
 	"log"
 	"net"
 	"os"
 	"strconv"
 	"strings"
+	"sync"
 	"time"
 )
 
-const MAX_PACKET_SIZE = 2048 // UDP packet buffer size.
-// const PRANGE_MIN = 10_000    // Lower component of port range.
-const MAX_PORTS = 100 // Upper component of port range.
-const ALPHA = 3       // For node lookup; how many nodes to query
-const PARAM_K = 20    // "k" value specified in original paper
-const RPC_TIMEOUT = 5 * time.Second
+const MAX_PACKET_SIZE = 2048               // UDP packet buffer size.
+const ALPHA = 3                            // For node lookup; how many nodes to query
+const PARAM_K = 20                         // "k" value specified in original paper
+const RPC_TIMEOUT = 2 * time.Second        // Default time to wait for a response, per attempt
+const RPC_RETRIES = 2                      // Default number of resends after the first attempt times out
+const RPC_BACKOFF = 100 * time.Millisecond // Default wait before the first resend, doubled for each resend
+const MAX_KNOWN_PEERS = 4096               // Most addresses whose version and capabilities are kept, see setPeer
+const STORE_QUORUM = 3                     // Default number of nodes that must acknowledge a store
 
 const (
 	// RPC Codes (byte[0] = 0)
@@ -28,36 +34,97 @@ const (
 	RPC_NODELOOKUP  byte = 0x05
 
 	// RPC Response codes (byte[0] = F)
-	RESP_VALFOUND     byte = 0xF0 // From store/findval, indicating value returned
-	RESP_CONTACTS     byte = 0xF1 // From findval/contact indicating a list of contacts
-	RESP_STORE_OK     byte = 0xF2 // Store has been a sucess
-	RESP_STORE_EXISTS byte = 0xF3 // Value already exists in the network
-	RESP_PING_OK      byte = 0xF4 // PING response
-	RESP_PING_FAIL    byte = 0xF5
+	RESP_VALFOUND            byte = 0xF0 // From store/findval, indicating value returned
+	RESP_CONTACTS            byte = 0xF1 // From findval/contact indicating a list of contacts
+	RESP_STORE_OK            byte = 0xF2 // Store has been a sucess
+	RESP_STORE_EXISTS        byte = 0xF3 // Value already exists in the network
+	RESP_PING_OK             byte = 0xF4 // PING response
+	RESP_PING_FAIL           byte = 0xF5
+	RESP_STORE_FAIL          byte = 0xF6 // Store could not be forwarded to the closest node
+	RESP_UNSUPPORTED_VERSION byte = 0xF7 // Request was in a later protocol version, data is [version, capabilities]
 )
 
+// Number of data fields each request needs, requests with fewer are dropped.
+var rpcFields = map[byte]int{
+	RPC_PING:        1,
+	RPC_STORE:       2,
+	RPC_FINDCONTACT: 1,
+	RPC_FINDVAL:     1,
+	RPC_NODELOOKUP:  1,
+}
+
+// Returned by SendAndWait when a peer does not answer within the deadline of any attempt.
+var ErrRPCTimeout = errors.New("rpc timed out")
+
+// Per-call settings for SendAndWaitWithOptions.
+type RPCOptions struct {
+	Timeout time.Duration // Time to wait for a response, per attempt
+	Retries int           // Number of resends after the first attempt
+	Backoff time.Duration // Wait before the first resend, doubled for each resend
+}
+
+// The options used by SendAndWait.
+func DefaultRPCOptions() RPCOptions {
+	return RPCOptions{RPC_TIMEOUT, RPC_RETRIES, RPC_BACKOFF}
+}
+
 type byte_arr_list [][]byte
 
 // Object containing all information needed for inter-node communication.
+// All requests and responses go through the single socket in conn;
+// responses are handed to the waiting caller through the pending table.
 type Network struct {
-	routing_table *RoutingTable
-	data_store    *Store
-	min_port      int
-	offset_port   int
+	routing_table   *RoutingTable
+	key             ed25519.PrivateKey // Signs every message sent, see sign.go
+	peer_keys       map[KademliaID]ed25519.PublicKey
+	bootstrap_addrs map[string]bool // Addresses that may send ids not derived from their key, see sign.go
+	keys_lock       sync.Mutex
+	strict_ids      bool // Only accept ids derived from the public key of the sender
+	data_store      *DataStore
+	conn            net.PacketConn
+	peers           map[string]peerInfo // Version and capabilities last received from each address, see setPeer
+	peers_lock      sync.Mutex
+	pending         map[AuthID]chan NetworkMessage
+	pending_lock    sync.Mutex
+	evicting        map[KademliaID]bool // Contacts currently being pinged before eviction
+	evict_lock      sync.Mutex
+	rpc_opts        RPCOptions    // Settings for RPCs sent by SendAndWait, lookups and the client API
+	store_quorum    int           // Number of acknowledgements a store needs, see SetStoreQuorum
+	ping_opts       RPCOptions    // Settings for liveness pings of least-recently seen contacts
+	refresh_stop    chan struct{} // Closed to stop the bucket refresher, see refresh.go
+	refresh_done    chan struct{}
+	refresh_lock    sync.Mutex
+	published       map[KademliaID]*publishedValue // Values put by this node, see republish.go
+	publish_lock    sync.Mutex
+	repub_stop      chan struct{} // Closed to stop the republisher, see republish.go
+	repub_done      chan struct{}
+	repub_lock      sync.Mutex
+	snapshot_stop   chan struct{} // Closed to stop the contact snapshots, see persist.go
+	snapshot_done   chan struct{}
+	snapshot_lock   sync.Mutex
 }
 
+// A request or response, sent over the network in the binary wire format of wire.go.
 type NetworkMessage struct {
-	Rpc         byte          `json:"rpc"`
-	Src_node_id string        `json:"src_node_id"`
-	Src_port    int           `json:"src_port"`
-	Resp_port   int           `json:"resp_port"`
-	Aid         string        `json:"aid"`
-	Data        byte_arr_list `json:"data"`
+	Version     byte   // Protocol version the message is encoded in
+	Caps        uint16 // Capabilities of the sender, see CAP_*
+	Rpc         byte
+	Src_node_id string
+	Src_port    int
+	Aid         string
+	Data        byte_arr_list
+	Pub         []byte // Public key of the sender, see sign.go
+	Sig         []byte // Signature over the message without Sig
+}
+
+// Wrapper func for messages sent over network
+func NewNetworkMessage(rpc byte, node_id *KademliaID, src_port int, auth_id *AuthID, data byte_arr_list) *NetworkMessage {
+	return &NetworkMessage{PROTOCOL_VERSION, LOCAL_CAPABILITIES, rpc, node_id.String(), src_port, auth_id.String(), data, nil, nil}
 }
 
-// Wrapper func for json data sent over network
-func NewNetworkMessage(rpc byte, node_id *KademliaID, src_port int, resp_port int, auth_id *AuthID, data byte_arr_list) *NetworkMessage {
-	return &NetworkMessage{rpc, node_id.String(), src_port, resp_port, auth_id.String(), data}
+// Returns true if the rpc code is a response code (see comms.go)
+func IsResponse(rpc byte) bool {
+	return rpc&0xF0 == 0xF0
 }
 
 func (network *Network) GetID() string {
@@ -69,121 +136,246 @@ func (network *Network) GetPort() int {
 	return port
 }
 
-// Create a new Network instance with random id,
+// Create a new Network instance with a new key, storing values in the given backend, see NewNetworkWithKey.
+func NewNetwork(this_ip string, port string, backend Store) *Network {
+	return NewNetworkWithKey(GenerateNodeKey(), this_ip, port, backend)
+}
+
+// Create a new Network instance with the given key, e.g. one restored by LoadNodeKey, and the id derived from it.
 // Unless it is the bootstrap node, whose nodeid is configured in the .env file.
-func NewNetwork(this_ip string, port string, min_port int) *Network {
-	addr := this_ip + ":" + port
+func NewNetworkWithKey(key ed25519.PrivateKey, this_ip string, port string, backend Store) *Network {
 	is_bootstrap, _ := strconv.ParseBool(os.Getenv("IS_BOOTSTRAP_NODE"))
-	var rtable *RoutingTable
-	if !is_bootstrap {
-		rtable = NewRoutingTable(NewContact(NewRandomKademliaID(), addr))
-	} else {
-		rtable = NewRoutingTable(NewContact(NewKademliaID(os.Getenv("BOOTSTRAP_NODE_ID")), addr))
+	if is_bootstrap {
+		return newNetwork(NewKademliaID(os.Getenv("BOOTSTRAP_NODE_ID")), key, this_ip, port, backend)
 	}
+	id := NewKademliaIDFromPublicKey(key.Public().(ed25519.PublicKey))
+	return newNetwork(id, key, this_ip, port, backend)
+}
+
+// The UDP socket is opened here so that requests can be sent before Listen is running.
+func newNetwork(id *KademliaID, key ed25519.PrivateKey, this_ip string, port string, backend Store) *Network {
+	addr := this_ip + ":" + port
+	me := NewContact(id, addr)
+	me.Version, me.Caps = PROTOCOL_VERSION, LOCAL_CAPABILITIES
+	rtable := NewRoutingTable(me)
+
+	conn, err := net.ListenPacket("udp", addr)
+	AssertAndCrash(err)
 
-	store := NewStore()
+	store := NewDataStore(backend)
 	fmt.Printf("NodeId: %s\n", rtable.me.ID.String())
-	return &Network{rtable, store, min_port, 0}
+	return &Network{
+		routing_table:   rtable,
+		key:             key,
+		peer_keys:       make(map[KademliaID]ed25519.PublicKey),
+		bootstrap_addrs: make(map[string]bool),
+		peers:           make(map[string]peerInfo),
+		data_store:      store,
+		conn:            conn,
+		pending:         make(map[AuthID]chan NetworkMessage),
+		evicting:        make(map[KademliaID]bool),
+		published:       make(map[KademliaID]*publishedValue),
+		rpc_opts:        DefaultRPCOptions(),
+		store_quorum:    STORE_QUORUM,
+		ping_opts:       DefaultRPCOptions(),
+	}
+}
+
+// Register a request as waiting for a response with the given auth id.
+func (network *Network) addPending(aid *AuthID) chan NetworkMessage {
+	ch := make(chan NetworkMessage, 1)
+	network.pending_lock.Lock()
+	network.pending[*aid] = ch
+	network.pending_lock.Unlock()
+	return ch
+}
+
+// Remove a request from the pending table once it is no longer waited on.
+func (network *Network) removePending(aid *AuthID) {
+	network.pending_lock.Lock()
+	delete(network.pending, *aid)
+	network.pending_lock.Unlock()
 }
 
-func (network *Network) GetNextPort() int {
-	offset := network.offset_port
-	network.offset_port++
-	if network.offset_port >= MAX_PORTS {
-		network.offset_port = 0
+// Hand a response to the request waiting on its auth id.
+// The request stops waiting with its first response, so a duplicate response is rejected just like
+// an unsolicited one. Returns false if nobody is waiting for it.
+func (network *Network) dispatchResponse(aid *AuthID, msg *NetworkMessage) bool {
+	network.pending_lock.Lock()
+	ch, ok := network.pending[*aid]
+	delete(network.pending, *aid)
+	network.pending_lock.Unlock()
+	if !ok {
+		return false
 	}
-	return network.min_port + offset
+	ch <- *msg
+	return true
 }
 
-// Send a UDP packet to a node/client. Then, start waiting for a UDP packet on same port.
-func (network *Network) SendAndWait(dist_ip string, rpc byte, params byte_arr_list) NetworkMessage {
-	chan_msg := make(chan NetworkMessage)
-	go func() {
-		resp_port := network.GetNextPort()
-		req_conn, err := net.Dial("udp", dist_ip)
-
-		// No defer; close connection directly after sending UDP packet
-		fmt.Printf("RPC: Sent RPC %s to %s from :%d\n", GetRPCName(rpc), dist_ip, resp_port)
-
-		// Format network packet (see docs)
-		aid_req := GenerateRandomAuthID()
-		msg := NewNetworkMessage(rpc, network.routing_table.me.ID, network.GetPort(), resp_port, aid_req, params)
-		msg_bytes, err := json.Marshal(msg)
-		AssertAndCrash(err)
-
-		read_ready := make(chan struct{})
-
-		go func() {
-			// Wait for response, where the auth id:s match
-			resp_conn, err := net.ListenPacket("udp", fmt.Sprintf(":%d", resp_port))
-			AssertAndCrash(err)
-			defer resp_conn.Close()
-			fmt.Printf("RPC: Waiting on :%d\n", resp_port)
-
-			for {
-				resp_buf := make([]byte, MAX_PACKET_SIZE)
-
-				select {
-				case <-read_ready:
-				default:
-					close(read_ready)
-				}
+// Send a UDP packet to a node/client from the listening socket,
+// then wait for the response with a matching auth id to be dispatched by Listen.
+// Uses the timeout and retry settings of the node, see SendAndWaitWithOptions.
+func (network *Network) SendAndWait(dist_ip string, rpc byte, params byte_arr_list) (NetworkMessage, error) {
+	return network.SendAndWaitWithOptions(dist_ip, rpc, params, network.rpc_opts)
+}
 
-				n, _, err := resp_conn.ReadFrom(resp_buf)
-				AssertAndCrash(err)
+// SendAndWait with explicit timeout and retry settings.
+func (network *Network) SendAndWaitWithOptions(dist_ip string, rpc byte, params byte_arr_list, opts RPCOptions) (NetworkMessage, error) {
+	return network.SendAndWaitContext(context.Background(), dist_ip, rpc, params, opts)
+}
 
-				var ret_msg *NetworkMessage
-				errd := json.Unmarshal(resp_buf[:n], &ret_msg)
-				AssertAndCrash(errd)
+// SendAndWait with explicit timeout and retry settings that gives up as soon as ctx is done.
+// The request is resent with the same auth id, so a late answer to an earlier attempt is still accepted.
+// A peer that answers with RESP_UNSUPPORTED_VERSION is asked again once, in the version of its answer.
+// A request that is not answered is never resent in an older version, since a lost packet would otherwise
+// downgrade two current nodes for good.
+// Returns ErrRPCTimeout if no attempt was answered, or the context error if ctx ended first.
+func (network *Network) SendAndWaitContext(ctx context.Context, dist_ip string, rpc byte, params byte_arr_list, opts RPCOptions) (NetworkMessage, error) {
+	resp, version, err := network.sendAndWait(ctx, dist_ip, rpc, params, opts)
+	if err == nil && resp.Rpc == RESP_UNSUPPORTED_VERSION && resp.Version < version {
+		fmt.Printf("RPC: %s only supports version %d, resending %s\n", dist_ip, resp.Version, GetRPCName(rpc))
+		resp, _, err = network.sendAndWait(ctx, dist_ip, rpc, params, opts)
+	}
+	if err == nil && resp.Rpc == RESP_UNSUPPORTED_VERSION {
+		return NetworkMessage{}, fmt.Errorf("%w: %s to %s", ErrUnsupportedVersion, GetRPCName(rpc), dist_ip)
+	}
+	return resp, err
+}
 
-				if ret_msg.Aid == aid_req.String() {
-					fmt.Printf("RPC: Response recieved on :%d\n", resp_port)
-					chan_msg <- *ret_msg
-					break
-				}
+// SendAndWaitContext without the version fallback. Also returns the protocol version the request was sent in.
+func (network *Network) sendAndWait(ctx context.Context, dist_ip string, rpc byte, params byte_arr_list, opts RPCOptions) (NetworkMessage, byte, error) {
+	aid_req := GenerateRandomAuthID()
+	chan_msg := network.addPending(aid_req)
+	defer network.removePending(aid_req)
+
+	msg := NewNetworkMessage(rpc, network.routing_table.me.ID, network.GetPort(), aid_req, params)
+	backoff := opts.Backoff
+	for attempt := 0; attempt <= opts.Retries; attempt++ {
+		if attempt > 0 {
+			fmt.Printf("RPC: Retrying %s to %s in %v (attempt %d)\n", GetRPCName(rpc), dist_ip, backoff, attempt+1)
+			select {
+			case resp := <-chan_msg:
+				return resp, msg.Version, nil
+			case <-ctx.Done():
+				return NetworkMessage{}, msg.Version, ctx.Err()
+			case <-time.After(backoff):
 			}
-		}()
-		<-read_ready
-		time.Sleep(10 * time.Microsecond)
-		_, err = req_conn.Write(msg_bytes)
-		req_conn.Close()
-		AssertAndCrash(err)
-	}()
-	return <-chan_msg
+			backoff *= 2
+		}
+
+		fmt.Printf("RPC: Sent RPC %s to %s (%s)\n", GetRPCName(rpc), dist_ip, aid_req.String())
+		if err := network.Send(dist_ip, msg); errors.Is(err, ErrMessageTooLarge) || errors.Is(err, ErrMalformedMessage) {
+			return NetworkMessage{}, msg.Version, err
+		}
+
+		timer := time.NewTimer(opts.Timeout)
+		select {
+		case resp := <-chan_msg:
+			timer.Stop()
+			return resp, msg.Version, nil
+		case <-ctx.Done():
+			timer.Stop()
+			return NetworkMessage{}, msg.Version, ctx.Err()
+		case <-timer.C:
+		}
+	}
+	return NetworkMessage{}, msg.Version, fmt.Errorf("%w: %s to %s after %d attempts", ErrRPCTimeout, GetRPCName(rpc), dist_ip, opts.Retries+1)
 }
 
 // Send function to send a response back to the specified address.
+// The message is signed and encoded in the wire format (see wire.go), in the version the peer last sent us;
+// returns ErrMessageTooLarge if it does not fit in one datagram.
 // Never use in implementation, rather use SendResponse or SendRPC
-func (network *Network) Send(dist_ip string, response *NetworkMessage) {
+func (network *Network) Send(dist_ip string, response *NetworkMessage) error {
 	resp_addr, err := net.ResolveUDPAddr("udp", dist_ip)
-	resp_bytes, err := json.Marshal(response)
-	AssertAndCrash(err)
 	if err != nil {
 		fmt.Printf("RPC: Error resolving %s: %v\n", dist_ip, err)
-		return
+		return err
+	}
+	response.Version = network.peerVersion(resp_addr.String())
+	if err := response.Sign(network.key); err != nil {
+		fmt.Printf("RPC: Error encoding %s: %v\n", GetRPCName(response.Rpc), err)
+		return err
 	}
-	conn, err := net.DialUDP("udp", nil, resp_addr)
+	resp_bytes, err := response.MarshalBinary()
 	if err != nil {
-		fmt.Printf("RPC: Error dialing UDP: %vn", err)
-		return
+		fmt.Printf("RPC: Error encoding %s: %v\n", GetRPCName(response.Rpc), err)
+		return err
 	}
-	defer conn.Close()
-	_, err = conn.Write(resp_bytes)
+	_, err = network.conn.WriteTo(resp_bytes, resp_addr)
+	if err != nil {
+		fmt.Printf("RPC: Error sending response: %v\n", err)
+		return err
+	}
+	fmt.Printf("RPC: Response sent to: %v\n", dist_ip)
+	return nil
+}
+
+// Protocol version and capabilities of the last message received from an address
+type peerInfo struct {
+	version byte
+	caps    uint16
+}
+
+// The protocol version to send to addr; the version last received from it, or PROTOCOL_VERSION.
+// Nodes answer in the version of the request, so that a peer that has not been upgraded yet can read the answer.
+func (network *Network) peerVersion(addr string) byte {
+	network.peers_lock.Lock()
+	defer network.peers_lock.Unlock()
+	if peer, ok := network.peers[addr]; ok {
+		return peer.version
+	}
+	return PROTOCOL_VERSION
+}
+
+// The capabilities last received from the node at dist_ip, or LOCAL_CAPABILITIES if it has not been heard from.
+func (network *Network) peerCaps(dist_ip string) uint16 {
+	addr, err := net.ResolveUDPAddr("udp", dist_ip)
 	if err != nil {
-		fmt.Printf("RPC: Error sending response: %vn", err)
-	} else {
-		fmt.Printf("RPC: Response sent to: %v\n", dist_ip)
+		return LOCAL_CAPABILITIES
+	}
+	network.peers_lock.Lock()
+	defer network.peers_lock.Unlock()
+	if peer, ok := network.peers[addr.String()]; ok {
+		return peer.caps
 	}
+	return LOCAL_CAPABILITIES
+}
+
+// Record the protocol version and capabilities of a message received from addr.
+// Once MAX_KNOWN_PEERS addresses are known, an arbitrary one is forgotten to make room.
+func (network *Network) setPeer(addr string, version byte, caps uint16) {
+	network.peers_lock.Lock()
+	defer network.peers_lock.Unlock()
+	if _, ok := network.peers[addr]; !ok && len(network.peers) >= MAX_KNOWN_PEERS {
+		for old := range network.peers {
+			delete(network.peers, old)
+			break
+		}
+	}
+	network.peers[addr] = peerInfo{version, caps}
+}
+
+// Tell the sender of a request in a later protocol version which version and capabilities we support.
+func (network *Network) SendUnsupportedVersion(aid *AuthID, dist_ip string) {
+	caps := make([]byte, 2)
+	binary.BigEndian.PutUint16(caps, LOCAL_CAPABILITIES)
+	network.SendResponseData(aid, dist_ip, RESP_UNSUPPORTED_VERSION, byte_arr_list{{PROTOCOL_VERSION}, caps})
 }
 
 // network.Send but with AID for responses
 func (network *Network) SendResponse(aid *AuthID, dist_ip string, response_rpc byte, response []byte) {
+	resp := make(byte_arr_list, 1)
+	resp[0] = response
+	network.SendResponseData(aid, dist_ip, response_rpc, resp)
+}
+
+// network.SendResponse with several data fields
+func (network *Network) SendResponseData(aid *AuthID, dist_ip string, response_rpc byte, response byte_arr_list) {
 	if response_rpc&0xF0 != 0xF0 {
 		fmt.Println("Warning: response rpc in SendResponse: does not seem to be of type response (see comms.go)")
 	}
-	resp := make(byte_arr_list, 1)
-	resp[0] = response
-	msg := NewNetworkMessage(response_rpc, network.routing_table.me.ID, network.GetPort(), -1, aid, resp)
+	msg := NewNetworkMessage(response_rpc, network.routing_table.me.ID, network.GetPort(), aid, response)
 	network.Send(dist_ip, msg)
 }
 
@@ -191,15 +383,15 @@ func (network *Network) SendResponse(aid *AuthID, dist_ip string, response_rpc b
 // Essentially SendAndWait without response handling
 func (network *Network) SendRPC(dist_ip string, rpc byte, params byte_arr_list) {
 	aid_req := GenerateRandomAuthID()
-	msg := NewNetworkMessage(rpc, network.routing_table.me.ID, network.GetPort(), -1, aid_req, params)
+	msg := NewNetworkMessage(rpc, network.routing_table.me.ID, network.GetPort(), aid_req, params)
 	network.Send(dist_ip, msg)
 }
 
 // Primary listening loop at UDP, default port in [project root]/.env.
 // Listen for incoming requests and handle accordingly.
+// Responses to our own requests are dispatched to the waiting SendAndWait call.
 func (network *Network) Listen() *Network {
-	conn, err := net.ListenPacket("udp", network.routing_table.me.Address)
-	AssertAndCrash(err)
+	conn := network.conn
 	defer conn.Close()
 	fmt.Printf("Main: Listening for requests on %s\n", network.routing_table.me.Address)
 
@@ -212,49 +404,80 @@ func (network *Network) Listen() *Network {
 		}
 		// TODO: Move to separate function
 		var msg NetworkMessage
-		err2 := json.Unmarshal(buf[:n], &msg)
-		if err2 != nil {
-			log.Println(err)
+		if err := msg.UnmarshalBinary(buf[:n]); err != nil {
+			fmt.Printf("Main: Dropped message from %s: %v\n", addr, err)
+			if errors.Is(err, ErrUnsupportedVersion) && !IsResponse(msg.Rpc) {
+				if aid, err := ParseAuthID(msg.Aid); err == nil {
+					go network.SendUnsupportedVersion(aid, addr.String())
+				}
+			}
 			continue
 		}
 
-		var aid_bytes [20]byte
-		copy([]byte(msg.Aid)[:], aid_bytes[:20])
-		aid := NewAuthID(aid_bytes)
-		fmt.Printf("Main: Received: %s (%x) from %s (%s -> %d)\n", GetRPCName(msg.Rpc), msg.Rpc, msg.Src_node_id, addr, msg.Resp_port)
+		src_id, err := network.verifyMessage(&msg, addr.String())
+		if err != nil {
+			fmt.Printf("Main: Dropped %s from %s: %v\n", GetRPCName(msg.Rpc), addr, err)
+			continue
+		}
+
+		aid, err := ParseAuthID(msg.Aid)
+		if err != nil {
+			fmt.Printf("Main: Dropped %s from %s: %v\n", GetRPCName(msg.Rpc), addr, err)
+			continue
+		}
+		fmt.Printf("Main: Received: %s (%x) from %s (%s)\n", GetRPCName(msg.Rpc), msg.Rpc, msg.Src_node_id, addr)
+
+		// Recorded before the response is dispatched, so that a resend after RESP_UNSUPPORTED_VERSION uses it
+		resp_addr := addr.String()
+		network.setPeer(resp_addr, msg.Version, msg.Caps)
+
+		// Responses nobody is waiting for never reach the routing table
+		is_response := IsResponse(msg.Rpc)
+		if is_response && !network.dispatchResponse(aid, &msg) {
+			fmt.Printf("Main: Dropped unsolicited or duplicate response %s (%s) from %s\n", GetRPCName(msg.Rpc), msg.Aid, addr)
+			continue
+		}
 
 		// Update routing table
-		src_ip, _ := ParsePortNumber(addr.String())
-		resp_addr := fmt.Sprintf("%s:%d", src_ip, msg.Resp_port)
-		network.routing_table.AddContact(NewContact(NewKademliaID(msg.Src_node_id), fmt.Sprintf("%s:%d", src_ip, msg.Src_port)))
-		for _, b := range network.routing_table.buckets {
-			for e := b.list.Front(); e != nil; e = e.Next() {
-				fmt.Printf("%s\n", e.Value)
-			}
+		if !src_id.Equals(network.routing_table.me.ID) {
+			contact := NewContact(src_id, resp_addr)
+			contact.Version, contact.Caps = msg.Version, msg.Caps
+			network.AddContact(contact)
+		}
+		if is_response {
+			continue
+		}
+		fields, ok := rpcFields[msg.Rpc]
+		if !ok {
+			fmt.Printf("Main: Invalid RPC: %x\n", msg.Rpc)
+			continue
+		}
+		if len(msg.Data) < fields {
+			fmt.Printf("Main: Dropped %s from %s: %d data fields, expected %d\n", GetRPCName(msg.Rpc), addr, len(msg.Data), fields)
+			continue
+		}
+		// The first field of every request is a node or value id
+		target := strings.TrimSpace(string(msg.Data[0]))
+		if _, err := ParseKademliaID(target); err != nil {
+			fmt.Printf("Main: Dropped %s from %s: %v\n", GetRPCName(msg.Rpc), addr, err)
+			continue
 		}
 
 		switch msg.Rpc {
 		case RPC_PING:
-			target := strings.TrimSpace(string(msg.Data[0]))
 			go network.ManagePing(aid, resp_addr, target)
 
 		case RPC_STORE:
-			go network.ManageStore(aid, resp_addr, string(msg.Data[0]), string(msg.Data[1]))
+			go network.ManageStore(aid, resp_addr, target, msg.Data[1], ParseTTL(msg.Data, 2))
 
 		case RPC_FINDCONTACT:
-			target := strings.TrimSpace(string(msg.Data[0]))
 			go network.ManageFindContact(aid, resp_addr, target)
 
 		case RPC_FINDVAL:
-			target := strings.TrimSpace(string(msg.Data[0]))
 			go network.ManageFindData(aid, resp_addr, target)
 
 		case RPC_NODELOOKUP:
-			target := strings.TrimSpace(string(msg.Data[0]))
 			go network.ManageNodeLookup(aid, resp_addr, target)
-
-		default:
-			fmt.Printf("Main: Invalid RPC: %s\n", string(msg.Rpc))
 		}
 	}
 }
@@ -0,0 +1,267 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"errors"
+	"fmt"
+	"net"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSendAndWaitTimeout verifies that an unanswered RPC returns ErrRPCTimeout after all retries.
+func TestSendAndWaitTimeout(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19100", NewMemoryStore())
+	go network.Listen()
+
+	// A socket that receives but never answers
+	silent, err := net.ListenPacket("udp", "127.0.0.1:19101")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	opts := RPCOptions{Timeout: 50 * time.Millisecond, Retries: 2, Backoff: 10 * time.Millisecond}
+	start := time.Now()
+	_, err = network.SendAndWaitWithOptions("127.0.0.1:19101", RPC_PING, byte_arr_list{[]byte(network.GetID())}, opts)
+	if !errors.Is(err, ErrRPCTimeout) {
+		t.Fatalf("Expected ErrRPCTimeout, got %v", err)
+	}
+	if time.Since(start) < 3*opts.Timeout {
+		t.Error("Returned before every attempt had timed out")
+	}
+}
+
+// TestSendAndWaitResponse verifies that a response is matched to its request over the shared socket.
+func TestSendAndWaitResponse(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19102", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19103", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+
+	resp, err := n1.SendAndWait("127.0.0.1:19103", RPC_PING, byte_arr_list{[]byte(n2.GetID())})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.Rpc != RESP_PING_OK {
+		t.Errorf("Expected RESP_PING_OK, got %x", resp.Rpc)
+	}
+}
+
+// TestDispatchResponse verifies that only the first response to a pending request is accepted.
+func TestDispatchResponse(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19104", NewMemoryStore())
+	aid := GenerateRandomAuthID()
+	msg := NewNetworkMessage(RESP_PING_OK, network.routing_table.me.ID, 1, aid, nil)
+
+	if network.dispatchResponse(aid, msg) {
+		t.Error("Unsolicited response was accepted")
+	}
+	ch := network.addPending(aid)
+	defer network.removePending(aid)
+	if !network.dispatchResponse(aid, msg) {
+		t.Error("Response to a pending request was rejected")
+	}
+	if network.dispatchResponse(aid, msg) {
+		t.Error("Duplicate response was accepted")
+	}
+	if resp := <-ch; resp.Aid != aid.String() {
+		t.Errorf("Expected the response for %s, got %s", aid.String(), resp.Aid)
+	}
+}
+
+// TestConcurrentRPCsSamePeer verifies that concurrent requests to one peer each get their own reply,
+// even when the peer answers them in reverse order and twice.
+func TestConcurrentRPCsSamePeer(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19105", NewMemoryStore())
+	go network.Listen()
+
+	// A peer that echoes the data of a request, answering later requests first
+	const n = 5
+	echo := NewNetwork("127.0.0.1", "19106", NewMemoryStore())
+	defer echo.conn.Close()
+	go func() {
+		type request struct {
+			aid  *AuthID
+			addr string
+			data []byte
+		}
+		var requests []request
+		buf := make([]byte, MAX_PACKET_SIZE)
+		for len(requests) < n {
+			size, addr, err := echo.conn.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg NetworkMessage
+			if msg.UnmarshalBinary(buf[:size]) != nil {
+				continue
+			}
+			aid, _ := ParseAuthID(msg.Aid)
+			requests = append(requests, request{aid, addr.String(), msg.Data[0]})
+		}
+		for i := n - 1; i >= 0; i-- {
+			echo.SendResponse(requests[i].aid, requests[i].addr, RESP_PING_FAIL, requests[i].data)
+			echo.SendResponse(requests[i].aid, requests[i].addr, RESP_PING_FAIL, []byte("duplicate"))
+		}
+	}()
+
+	opts := RPCOptions{Timeout: time.Second, Retries: 0}
+	var wg sync.WaitGroup
+	for i := 0; i < n; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			data := fmt.Sprintf("request %d", i)
+			resp, err := network.SendAndWaitWithOptions("127.0.0.1:19106", RPC_PING, byte_arr_list{[]byte(data)}, opts)
+			if err != nil {
+				t.Errorf("Request %d failed: %v", i, err)
+				return
+			}
+			if string(resp.Data[0]) != data {
+				t.Errorf("Request %d got the reply %q", i, resp.Data[0])
+			}
+		}(i)
+	}
+	wg.Wait()
+}
+
+// Send a raw request to addr from conn and decode the response.
+func exchange(t *testing.T, conn net.PacketConn, addr string, msg *NetworkMessage, data []byte) NetworkMessage {
+	if data == nil {
+		var err error
+		if data, err = msg.MarshalBinary(); err != nil {
+			t.Fatal(err)
+		}
+	}
+	udp_addr, _ := net.ResolveUDPAddr("udp", addr)
+	conn.WriteTo(data, udp_addr)
+
+	buf := make([]byte, MAX_PACKET_SIZE)
+	conn.SetReadDeadline(time.Now().Add(time.Second))
+	n, _, err := conn.ReadFrom(buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	var resp NetworkMessage
+	if err := resp.UnmarshalBinary(buf[:n]); err != nil {
+		t.Fatal(err)
+	}
+	return resp
+}
+
+// TestUnsupportedVersions verifies that a request in a later version is answered with RESP_UNSUPPORTED_VERSION,
+// and that one in an earlier format is dropped without an answer.
+func TestUnsupportedVersions(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19210", NewMemoryStore())
+	go network.Listen()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:19211")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	key := GenerateNodeKey()
+	id := NewKademliaIDFromPublicKey(key.Public().(ed25519.PublicKey))
+	params := byte_arr_list{[]byte(network.GetID())}
+
+	msg := NewNetworkMessage(RPC_PING, id, 19211, GenerateRandomAuthID(), params)
+	data, _ := msg.MarshalBinary()
+	data[0] = PROTOCOL_VERSION + 1
+	resp := exchange(t, conn, "127.0.0.1:19210", msg, data)
+	assert.Equal(t, RESP_UNSUPPORTED_VERSION, resp.Rpc)
+	assert.Equal(t, msg.Aid, resp.Aid)
+	assert.Equal(t, []byte{PROTOCOL_VERSION}, []byte(resp.Data[0]))
+
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:19210")
+	for _, data := range [][]byte{{MIN_PROTOCOL_VERSION - 1}, []byte(`{"rpc":1,"resp_port":19211}`)} {
+		conn.WriteTo(data, addr)
+		conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+		_, _, err = conn.ReadFrom(make([]byte, MAX_PACKET_SIZE))
+		assert.Error(t, err, "Expected no answer to an earlier format")
+	}
+}
+
+// TestUnsupportedVersionReply verifies that a RESP_UNSUPPORTED_VERSION in the version of the request
+// is returned as ErrUnsupportedVersion without resending the request.
+func TestUnsupportedVersionReply(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19212", NewMemoryStore())
+	go network.Listen()
+	peer, err := net.ListenPacket("udp", "127.0.0.1:19213")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer peer.Close()
+
+	key := GenerateNodeKey()
+	id := NewKademliaIDFromPublicKey(key.Public().(ed25519.PublicKey))
+	requests := make(chan byte, 2)
+	go func() {
+		buf := make([]byte, MAX_PACKET_SIZE)
+		for {
+			n, addr, err := peer.ReadFrom(buf)
+			if err != nil {
+				return
+			}
+			var msg NetworkMessage
+			if msg.UnmarshalBinary(buf[:n]) != nil {
+				continue
+			}
+			requests <- msg.Version
+			aid, _ := ParseAuthID(msg.Aid)
+			resp := NewNetworkMessage(RESP_UNSUPPORTED_VERSION, id, 19213, aid, byte_arr_list{{PROTOCOL_VERSION}})
+			resp.Sign(key)
+			data, _ := resp.MarshalBinary()
+			peer.WriteTo(data, addr)
+		}
+	}()
+
+	_, err = network.SendAndWait("127.0.0.1:19213", RPC_PING, byte_arr_list{[]byte(id.String())})
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+	assert.Equal(t, PROTOCOL_VERSION, <-requests)
+	assert.Len(t, requests, 0, "Expected the request not to be resent")
+}
+
+// TestValueTTLCapability verifies that the TTL of a value is only sent to nodes with CAP_VALUE_TTL.
+func TestValueTTLCapability(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19256", NewMemoryStore())
+	go network.Listen()
+	conn, err := net.ListenPacket("udp", "127.0.0.1:19257")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	key := GenerateNodeKey()
+	id := NewKademliaIDFromPublicKey(key.Public().(ed25519.PublicKey))
+	value_id := GetValueID("ttl")
+	network.data_store.Store(value_id, []byte("value"))
+	assert.Equal(t, LOCAL_CAPABILITIES, network.peerCaps("127.0.0.1:19257"), "Expected a peer not heard from to be sent every field")
+
+	for caps, fields := range map[uint16]int{0: 1, LOCAL_CAPABILITIES: 2} {
+		msg := NewNetworkMessage(RPC_FINDVAL, id, 19257, GenerateRandomAuthID(), byte_arr_list{[]byte(value_id.String())})
+		msg.Caps = caps
+		msg.Sign(key)
+		resp := exchange(t, conn, "127.0.0.1:19256", msg, nil)
+		assert.Equal(t, RESP_VALFOUND, resp.Rpc)
+		assert.Len(t, resp.Data, fields, "Expected the TTL only with CAP_VALUE_TTL")
+		assert.Equal(t, caps, network.peerCaps("127.0.0.1:19257"))
+		assert.Len(t, storeParams(value_id, []byte("value"), time.Minute, caps), fields+1)
+	}
+}
+
+// TestKnownPeersBounded verifies that no more than MAX_KNOWN_PEERS addresses are remembered.
+func TestKnownPeersBounded(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19258", NewMemoryStore())
+	for i := 0; i < MAX_KNOWN_PEERS+10; i++ {
+		network.setPeer(fmt.Sprintf("10.0.%d.%d:8008", i/256, i%256), PROTOCOL_VERSION, 0)
+	}
+	assert.Len(t, network.peers, MAX_KNOWN_PEERS)
+	network.setPeer("127.0.0.1:19259", PROTOCOL_VERSION, LOCAL_CAPABILITIES)
+	_, ok := network.peers["127.0.0.1:19259"]
+	assert.True(t, ok, "Expected the latest peer to be kept")
+	assert.Len(t, network.peers, MAX_KNOWN_PEERS)
+}
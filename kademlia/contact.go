@@ -6,16 +6,19 @@ import (
 )
 
 // Contact definition
-// stores the KademliaID, the ip address and the distance
+// stores the KademliaID, the ip address, the protocol version and capabilities
+// the contact advertised (see wire.go) and the distance
 type Contact struct {
 	ID       *KademliaID
 	Address  string
+	Version  byte   // VERSION_UNKNOWN until the contact has been heard from directly
+	Caps     uint16 // Capabilities, see CAP_*
 	distance *KademliaID
 }
 
-// NewContact returns a new instance of a Contact
+// NewContact returns a new instance of a Contact that has not been heard from
 func NewContact(id *KademliaID, address string) Contact {
-	return Contact{id, address, nil}
+	return Contact{id, address, VERSION_UNKNOWN, 0, nil}
 }
 
 // CalcDistance calculates the distance to the target and 
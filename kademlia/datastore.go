@@ -0,0 +1,196 @@
+package kademlia
+
+import (
+	"log"
+	"sync"
+	"time"
+)
+
+// Values held by this node, kept in a Store backend.
+// Adds expiry and refresh times on top of the backend, and a sweeper removing expired entries.
+// lock makes the read-modify-write of StoreWithTTL and TouchEntry atomic, the backend guards itself otherwise.
+type DataStore struct {
+	backend    Store
+	lock       sync.Mutex
+	sweep_stop chan struct{}
+}
+
+func NewDataStore(backend Store) *DataStore {
+	return &DataStore{backend: backend}
+}
+
+// The storage backend, e.g. for its Stats
+func (store *DataStore) Backend() Store {
+	return store.backend
+}
+
+// Returns an entry holding a copy of value, so that the caller may reuse it.
+func (store *DataStore) NewEntry(hash *KademliaID, value []byte) *Entry {
+	now := time.Now()
+	return &Entry{hash, append([]byte{}, value...), now.Add(DEFAULT_VALUE_TTL), now}
+}
+
+// Store a value with the default TTL, see StoreWithTTL.
+func (store *DataStore) Store(hash *KademliaID, value []byte) bool {
+	return store.StoreWithTTL(hash, value, DEFAULT_VALUE_TTL)
+}
+
+// Store a value that expires after ttl. Returns false if the value is already stored,
+// in which case its expiry is pushed back if the new ttl outlives it.
+// Either way the entry counts as refreshed, see StaleEntries.
+// A stored value that does not match a content-addressed key is replaced by one that does, see IsContentAddressed.
+// A value the backend fails to store is logged and reported as not stored, see Insert.
+func (store *DataStore) StoreWithTTL(hash *KademliaID, value []byte, ttl time.Duration) bool {
+	stored, err := store.Insert(hash, value, ttl)
+	if err != nil {
+		log.Printf("Store: Storing %s failed: %v\n", hash.String(), err)
+	}
+	return stored
+}
+
+// StoreWithTTL that also returns the error of the backend.
+func (store *DataStore) Insert(hash *KademliaID, value []byte, ttl time.Duration) (bool, error) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	expires := now.Add(ttl)
+	if e, ok := store.backend.Get(hash); ok && !e.Expired(now) && (IsContentAddressed(hash, e.value) || !IsContentAddressed(hash, value)) {
+		log.Println("Value is already stored")
+		if expires.After(e.expires) {
+			e.expires = expires
+		}
+		e.refreshed = now
+		return false, store.backend.Put(e)
+	}
+	ne := store.NewEntry(hash, value)
+	ne.expires = expires
+	if err := store.backend.Put(*ne); err != nil {
+		return false, err
+	}
+	return true, nil
+}
+
+// Returns the unexpired entry with the given key
+func (store *DataStore) find(hash *KademliaID) (Entry, bool) {
+	e, ok := store.backend.Get(hash)
+	if !ok || e.Expired(time.Now()) {
+		return Entry{}, false
+	}
+	return e, true
+}
+
+// Returns the unexpired value with the given key, which must not be modified.
+func (store *DataStore) GetEntry(hash *KademliaID) ([]byte, bool) {
+	if e, ok := store.find(hash); ok {
+		return e.value, true
+	}
+	log.Println("Value is not stored")
+	return nil, false
+}
+
+// Returns the time left until the value with the given key expires.
+func (store *DataStore) GetTTL(hash *KademliaID) (time.Duration, bool) {
+	if e, ok := store.find(hash); ok {
+		return time.Until(e.expires), true
+	}
+	return 0, false
+}
+
+func (store *DataStore) EntryExists(hash *KademliaID) bool {
+	_, ok := store.find(hash)
+	return ok
+}
+
+// Returns copies of the unexpired entries that have not been refreshed within max_age.
+func (store *DataStore) StaleEntries(max_age time.Duration) []Entry {
+	now := time.Now()
+	var stale []Entry
+	store.backend.Iterate(func(e Entry) bool {
+		if !e.Expired(now) && now.Sub(e.refreshed) >= max_age {
+			stale = append(stale, e)
+		}
+		return true
+	})
+	return stale
+}
+
+// Mark the entry with the given key as refreshed, e.g. after it has been replicated.
+func (store *DataStore) TouchEntry(hash *KademliaID) {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if e, ok := store.find(hash); ok {
+		e.refreshed = time.Now()
+		if err := store.backend.Put(e); err != nil {
+			log.Printf("Store: Touching %s failed: %v\n", hash.String(), err)
+		}
+	}
+}
+
+// Returns the size of the backend
+func (store *DataStore) Stats() StoreStats {
+	return store.backend.Stats()
+}
+
+// Remove all expired entries, returns the number of entries removed.
+func (store *DataStore) RemoveExpired() int {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	now := time.Now()
+	var expired []*KademliaID
+	store.backend.Iterate(func(e Entry) bool {
+		if e.Expired(now) {
+			expired = append(expired, e.key)
+		}
+		return true
+	})
+	removed := 0
+	for _, key := range expired {
+		if err := store.backend.Delete(key); err != nil {
+			log.Printf("Store: Removing %s failed: %v\n", key.String(), err)
+			continue
+		}
+		removed++
+	}
+	return removed
+}
+
+// Start removing expired entries in the background every interval.
+// A sweeper that is already running is stopped first.
+func (store *DataStore) StartSweeper(interval time.Duration) {
+	store.StopSweeper()
+
+	stop := make(chan struct{})
+	store.lock.Lock()
+	store.sweep_stop = stop
+	store.lock.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := store.RemoveExpired(); n > 0 {
+					log.Printf("Store: Removed %d expired entries\n", n)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the background sweeper, does nothing if it is not running.
+func (store *DataStore) StopSweeper() {
+	store.lock.Lock()
+	stop := store.sweep_stop
+	store.sweep_stop = nil
+	store.lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+	}
+}
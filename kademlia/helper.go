@@ -4,13 +4,15 @@ package kademlia
 // depend on any other structs.
 
 import (
-	"bytes"
 	"crypto/sha1"
-	"encoding/gob"
+	"encoding/binary"
 	"fmt"
 	"log"
 	"strconv"
 	"strings"
+	"time"
+	"unicode"
+	"unicode/utf8"
 )
 
 // Used to test an error and crash if it isnt nil.
@@ -70,35 +72,77 @@ func GetValueID(val string) *KademliaID {
 	return NewKademliaID(s)
 }
 
+// Returns true if value is text that can be shown on one line, i.e. valid UTF-8 without control characters
+func IsPrintable(value []byte) bool {
+	if !utf8.Valid(value) {
+		return false
+	}
+	for _, r := range string(value) {
+		if unicode.IsControl(r) {
+			return false
+		}
+	}
+	return true
+}
+
+// data bytes -> kademlia id, the same as GetValueID(string(data))
+func GetDataID(data []byte) *KademliaID {
+	id := KademliaID(sha1.Sum(data))
+	return &id
+}
+
+// Returns true if key is the hash of value, see GetDataID.
+// A value under such a content-addressed key can be checked by anyone; it replaces a stored value
+// that does not match (see DataStore.Insert), and lookups prefer it (see FindValue).
+// Keys made from a name (see GetValueID) never match their value, so their values cannot be checked.
+func IsContentAddressed(key *KademliaID, value []byte) bool {
+	return GetDataID(value).Equals(key)
+}
+
 // Format contact list to printable string
 func ParseContactList(raw []byte) string {
-	buff := bytes.NewBuffer(raw)
-	data := NetDeserialize[[]Contact](buff.Bytes())
+	data, err := DecodeContacts(raw)
+	if err != nil {
+		return "[ERR]"
+	}
+	return FormatContactList(data)
+}
+
+// Format already deserialized contacts to printable string
+func FormatContactList(contacts []Contact) string {
 	ret := ""
-	for _, e := range data {
+	for _, e := range contacts {
 		line := fmt.Sprintf("<%s, %s>", e.Address, e.ID.String())
 		ret = ret + line
 	}
 	return ret
 }
 
-func Trim(s string) string {
-	return strings.ReplaceAll(strings.TrimSpace(s), "\x00", "")
+// Parse the TTL sent in data[index] of a STORE rpc or FINDVAL response (see EncodeTTL),
+// falling back to DEFAULT_VALUE_TTL if it is missing or malformed and clamped to MAX_VALUE_TTL
+func ParseTTL(data byte_arr_list, index int) time.Duration {
+	if len(data) <= index || len(data[index]) != 4 {
+		return DEFAULT_VALUE_TTL
+	}
+	ttl := time.Duration(binary.BigEndian.Uint32(data[index])) * time.Millisecond
+	if ttl <= 0 {
+		return DEFAULT_VALUE_TTL
+	}
+	return min(ttl, MAX_VALUE_TTL)
 }
 
-func NetSerialize[T any](data any) []byte {
-	var buff bytes.Buffer
-	encoder := gob.NewEncoder(&buff)
-	err := encoder.Encode(data)
-	AssertAndCrash(err)
-	return buff.Bytes()
+// Split a comma separated list of bootstrap addresses, e.g. "node-a:8008, node-b:8008"
+func ParseBootstrapList(list string) []string {
+	var addrs []string
+	for _, addr := range strings.Split(list, ",") {
+		addr = strings.TrimSpace(addr)
+		if addr != "" {
+			addrs = append(addrs, addr)
+		}
+	}
+	return addrs
 }
 
-func NetDeserialize[T any](data []byte) T {
-	byte_buffer := bytes.NewBuffer(data)
-	var ret T
-	decoder := gob.NewDecoder(byte_buffer)
-	err := decoder.Decode(&ret)
-	AssertAndCrash(err)
-	return ret
+func Trim(s string) string {
+	return strings.ReplaceAll(strings.TrimSpace(s), "\x00", "")
 }
@@ -1 +1,33 @@
 package kademlia
+
+import (
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestParseBootstrapList verifies that addresses are split, trimmed and empty entries skipped.
+func TestParseBootstrapList(t *testing.T) {
+	assert.Equal(t, []string{"node-a:8008", "node-b:8008"}, ParseBootstrapList(" node-a:8008,,node-b:8008 "))
+	assert.Empty(t, ParseBootstrapList(""))
+}
+
+// TestParseTTL verifies that a TTL survives encoding, that a missing or malformed TTL falls back to the default,
+// and that a TTL longer than MAX_VALUE_TTL is clamped.
+func TestParseTTL(t *testing.T) {
+	data := byte_arr_list{[]byte("key"), []byte("value"), EncodeTTL(90 * time.Second), []byte("1m30s")}
+	assert.Equal(t, 90*time.Second, ParseTTL(data, 2))
+	assert.Equal(t, DEFAULT_VALUE_TTL, ParseTTL(data, 3))
+	assert.Equal(t, DEFAULT_VALUE_TTL, ParseTTL(data, 4))
+	assert.Equal(t, DEFAULT_VALUE_TTL, ParseTTL(data, 1))
+	assert.Equal(t, MAX_VALUE_TTL, ParseTTL(byte_arr_list{EncodeTTL(100 * 365 * 24 * time.Hour)}, 0))
+	assert.Equal(t, MAX_VALUE_TTL, ParseTTL(byte_arr_list{{0xff, 0xff, 0xff, 0xff}}, 0))
+}
+
+// TestIsPrintable verifies that binary values and values spanning several lines are not shown as text.
+func TestIsPrintable(t *testing.T) {
+	assert.True(t, IsPrintable([]byte("value with spaces, åäö")))
+	assert.False(t, IsPrintable([]byte("two\nlines")))
+	assert.False(t, IsPrintable([]byte{0xff, 0x00}))
+}
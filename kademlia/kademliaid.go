@@ -1,8 +1,10 @@
 package kademlia
 
 import (
+	"crypto/rand"
+	"crypto/sha1"
 	"encoding/hex"
-	"math/rand"
+	"fmt"
 	"strings"
 )
 
@@ -26,16 +28,42 @@ func NewKademliaID(data string) *KademliaID {
 	return &newKademliaID
 }
 
+// ParseKademliaID returns the KademliaID in the hex string input,
+// or an error if it is not a valid id
+func ParseKademliaID(data string) (*KademliaID, error) {
+	decoded, err := hex.DecodeString(data)
+	if err != nil {
+		return nil, err
+	}
+	if len(decoded) != IDLength {
+		return nil, fmt.Errorf("id %q is not %d bytes long", data, IDLength)
+	}
+	newKademliaID := KademliaID{}
+	copy(newKademliaID[:], decoded)
+	return &newKademliaID, nil
+}
+
 // NewRandomKademliaID returns a new instance of a random KademliaID,
-// change this to a better version if you like
+// read from crypto/rand so that nodes started at the same time never get correlated ids
 func NewRandomKademliaID() *KademliaID {
 	newKademliaID := KademliaID{}
-	for i := 0; i < IDLength; i++ {
-		newKademliaID[i] = uint8(rand.Intn(256))
-	}
+	_, err := rand.Read(newKademliaID[:])
+	AssertAndCrash(err)
 	return &newKademliaID
 }
 
+// NewKademliaIDFromPublicKey returns the KademliaID derived from a public key,
+// the SHA-1 hash of the key, so that peers can verify the id instead of trusting it
+func NewKademliaIDFromPublicKey(publicKey []byte) *KademliaID {
+	newKademliaID := KademliaID(sha1.Sum(publicKey))
+	return &newKademliaID
+}
+
+// MatchesPublicKey returns true if the KademliaID is the one derived from the public key
+func (kademliaID *KademliaID) MatchesPublicKey(publicKey []byte) bool {
+	return kademliaID.Equals(NewKademliaIDFromPublicKey(publicKey))
+}
+
 // Less returns true if kademliaID < otherKademliaID (bitwise)
 func (kademliaID KademliaID) Less(otherKademliaID *KademliaID) bool {
 	for i := 0; i < IDLength; i++ {
@@ -1,6 +1,7 @@
 package kademlia
 
 import (
+	"crypto/sha1"
 	"testing"
 )
 
@@ -83,3 +84,35 @@ func TestKademliaIDEquals(t *testing.T) {
 		t.Errorf("Expected %x not to equal %x", *id1, *id2)
 	}
 }
+
+// TestNewRandomKademliaID verifies that random ids do not repeat.
+func TestNewRandomKademliaID(t *testing.T) {
+	seen := make(map[KademliaID]bool)
+	for i := 0; i < 1000; i++ {
+		id := NewRandomKademliaID()
+		if seen[*id] {
+			t.Fatalf("Random id %s repeated", id.String())
+		}
+		seen[*id] = true
+	}
+}
+
+// TestKademliaIDFromPublicKey verifies that an id derived from a key matches that key only.
+func TestKademliaIDFromPublicKey(t *testing.T) {
+	key := []byte("a public key")
+	id := NewKademliaIDFromPublicKey(key)
+
+	expected := sha1.Sum(key)
+	if *id != KademliaID(expected) {
+		t.Errorf("Expected KademliaID %x, got %x", expected, *id)
+	}
+	if !id.MatchesPublicKey(key) {
+		t.Error("Id does not match the key it was derived from")
+	}
+	if id.MatchesPublicKey([]byte("another public key")) {
+		t.Error("Id matches a different key")
+	}
+	if NewRandomKademliaID().MatchesPublicKey(key) {
+		t.Error("Random id matches a key")
+	}
+}
@@ -0,0 +1,249 @@
+package kademlia
+
+// This file contains a Store backend that persists entries to an append-only log file.
+// Every put and delete is appended as one JSON record per line and synced to disk, with values base64 encoded,
+// and the entries are kept in memory as well so that reads never touch the file.
+// On open the log is replayed to rebuild the entries; a record torn by a crash
+// at the end of the log is dropped. The log is compacted once most of its records are dead.
+
+import (
+	"bufio"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"sync"
+	"time"
+)
+
+const logCompactThreshold = 1024 // Minimum number of records before the log is compacted
+
+const (
+	logOpPut    = "put"
+	logOpDelete = "del"
+)
+
+// One line of the log
+type logRecord struct {
+	Op        string `json:"op"`
+	Key       string `json:"key"`
+	Data      []byte `json:"data,omitempty"`
+	Expires   int64  `json:"expires,omitempty"`   // Unix nanoseconds
+	Refreshed int64  `json:"refreshed,omitempty"` // Unix nanoseconds
+}
+
+// Store backend persisting its entries to an append-only log, see above.
+// lock guards the file and the record count, index guards itself.
+type LogStore struct {
+	path    string
+	file    *os.File
+	index   *MemoryStore
+	records int // Number of records in the log, live or not
+	lock    sync.Mutex
+}
+
+// Open the log at path, creating it if it does not exist, and replay it.
+func NewLogStore(path string) (*LogStore, error) {
+	store := &LogStore{path: path, index: NewMemoryStore()}
+	if err := store.replay(); err != nil {
+		return nil, err
+	}
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0644)
+	if err != nil {
+		return nil, err
+	}
+	store.file = file
+	store.compactIfNeeded()
+	return store, nil
+}
+
+// Rebuild the entries from the log, truncating a torn record at its end.
+func (store *LogStore) replay() error {
+	file, err := os.OpenFile(store.path, os.O_RDWR|os.O_CREATE, 0644)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	reader := bufio.NewReader(file)
+	var good int64 // Offset after the last complete record
+	for {
+		line, err := reader.ReadBytes('\n')
+		if err == io.EOF {
+			if len(line) > 0 {
+				fmt.Printf("LogStore: Dropping torn record of %d bytes at the end of %s\n", len(line), store.path)
+				return file.Truncate(good)
+			}
+			return nil
+		}
+		if err != nil {
+			return err
+		}
+		good += int64(len(line))
+		store.records++
+
+		var rec logRecord
+		if err := json.Unmarshal(line, &rec); err != nil {
+			fmt.Printf("LogStore: Skipping corrupt record in %s: %v\n", store.path, err)
+			continue
+		}
+		if err := store.apply(rec); err != nil {
+			fmt.Printf("LogStore: Skipping invalid record in %s: %v\n", store.path, err)
+		}
+	}
+}
+
+// Apply a replayed record to the index
+func (store *LogStore) apply(rec logRecord) error {
+	decoded, err := ParseKademliaID(rec.Key)
+	if err != nil {
+		return err
+	}
+	switch rec.Op {
+	case logOpPut:
+		return store.index.Put(Entry{decoded, rec.Data, time.Unix(0, rec.Expires), time.Unix(0, rec.Refreshed)})
+	case logOpDelete:
+		return store.index.Delete(decoded)
+	default:
+		return fmt.Errorf("unknown op %q", rec.Op)
+	}
+}
+
+// Append a record to the log and sync it to disk. Must hold lock
+func (store *LogStore) append(rec logRecord) error {
+	if store.file == nil {
+		return errors.New("log store is closed")
+	}
+	line, err := json.Marshal(rec)
+	if err != nil {
+		return err
+	}
+	if _, err := store.file.Write(append(line, '\n')); err != nil {
+		return err
+	}
+	store.records++
+	return store.file.Sync()
+}
+
+// Returns true if most of the records in the log are dead. Must hold lock
+func (store *LogStore) needsCompaction() bool {
+	return store.records > logCompactThreshold && store.records > 2*store.index.Stats().Entries
+}
+
+// Compact the log if most of its records are dead. A failed compaction leaves the old log in place. Must hold lock
+func (store *LogStore) compactIfNeeded() {
+	if !store.needsCompaction() {
+		return
+	}
+	if err := store.compact(); err != nil {
+		fmt.Printf("LogStore: Compacting %s failed: %v\n", store.path, err)
+	}
+}
+
+// Rewrite the log with a single record per entry, replacing the old log atomically. Must hold lock
+func (store *LogStore) compact() error {
+	if store.file == nil {
+		return errors.New("log store is closed")
+	}
+	// Opened for appending, so that it becomes the log file once renamed and no reopen can fail afterwards
+	tmp_path := store.path + ".tmp"
+	tmp, err := os.OpenFile(tmp_path, os.O_WRONLY|os.O_APPEND|os.O_CREATE|os.O_TRUNC, 0644)
+	if err != nil {
+		return err
+	}
+	writer := bufio.NewWriter(tmp)
+	records := 0
+	var write_err error
+	store.index.Iterate(func(e Entry) bool {
+		var line []byte
+		line, write_err = json.Marshal(putRecord(e))
+		if write_err == nil {
+			_, write_err = writer.Write(append(line, '\n'))
+		}
+		records++
+		return write_err == nil
+	})
+	if write_err == nil {
+		write_err = writer.Flush()
+	}
+	if write_err == nil {
+		write_err = tmp.Sync()
+	}
+	if write_err == nil {
+		write_err = os.Rename(tmp_path, store.path)
+	}
+	if write_err != nil {
+		tmp.Close()
+		os.Remove(tmp_path)
+		return write_err
+	}
+
+	store.file.Close()
+	store.file = tmp
+	store.records = records
+	return nil
+}
+
+func putRecord(e Entry) logRecord {
+	return logRecord{Op: logOpPut, Key: e.key.String(), Data: e.value, Expires: e.expires.UnixNano(), Refreshed: e.refreshed.UnixNano()}
+}
+
+func (store *LogStore) Put(entry Entry) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if err := store.append(putRecord(entry)); err != nil {
+		return err
+	}
+	store.index.Put(entry)
+	store.compactIfNeeded()
+	return nil
+}
+
+func (store *LogStore) Get(key *KademliaID) (Entry, bool) {
+	return store.index.Get(key)
+}
+
+func (store *LogStore) Delete(key *KademliaID) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if _, ok := store.index.Get(key); !ok {
+		return nil
+	}
+	if err := store.append(logRecord{Op: logOpDelete, Key: key.String()}); err != nil {
+		return err
+	}
+	store.index.Delete(key)
+	store.compactIfNeeded()
+	return nil
+}
+
+func (store *LogStore) Iterate(fn func(entry Entry) bool) error {
+	return store.index.Iterate(fn)
+}
+
+func (store *LogStore) Stats() StoreStats {
+	return store.index.Stats()
+}
+
+// Compact the log now, see above.
+func (store *LogStore) Compact() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+	return store.compact()
+}
+
+// Close the log file. Writes fail afterwards, reads keep working.
+func (store *LogStore) Close() error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if store.file == nil {
+		return nil
+	}
+	err := store.file.Close()
+	store.file = nil
+	return err
+}
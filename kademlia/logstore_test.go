@@ -0,0 +1,113 @@
+package kademlia
+
+import (
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLogStoreRecovers verifies that puts and deletes survive reopening the log.
+func TestLogStoreRecovers(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store, err := NewLogStore(path)
+	assert.NoError(t, err)
+
+	data := NewDataStore(store)
+	id1 := GetValueID("one")
+	id2 := GetValueID("two")
+	assert.True(t, data.StoreWithTTL(id1, []byte("one"), time.Hour))
+	assert.True(t, data.Store(id2, []byte("two")))
+	assert.NoError(t, store.Delete(id2))
+	ttl, _ := data.GetTTL(id1)
+	assert.NoError(t, store.Close())
+
+	store, err = NewLogStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	data = NewDataStore(store)
+	val, ok := data.GetEntry(id1)
+	assert.True(t, ok)
+	assert.Equal(t, []byte("one"), val)
+	recovered_ttl, _ := data.GetTTL(id1)
+	assert.InDelta(t, ttl, recovered_ttl, float64(time.Second), "Expiry was not recovered")
+	assert.False(t, data.EntryExists(id2), "Deleted entry was recovered")
+	assert.Equal(t, StoreStats{Entries: 1, Bytes: 3}, store.Stats())
+}
+
+// TestLogStoreTornRecord verifies that a record cut short by a crash is dropped and the log stays usable.
+func TestLogStoreTornRecord(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store, err := NewLogStore(path)
+	assert.NoError(t, err)
+	assert.NoError(t, store.Put(*NewStore().NewEntry(GetValueID("kept"), []byte("kept"))))
+	assert.NoError(t, store.Close())
+
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND, 0644)
+	assert.NoError(t, err)
+	file.WriteString(`{"op":"put","key":"`)
+	file.Close()
+
+	store, err = NewLogStore(path)
+	assert.NoError(t, err)
+	assert.Equal(t, 1, store.Stats().Entries)
+	assert.NoError(t, store.Put(*NewStore().NewEntry(GetValueID("after"), []byte("after"))))
+	assert.NoError(t, store.Close())
+
+	store, err = NewLogStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	_, ok := store.Get(GetValueID("kept"))
+	assert.True(t, ok)
+	_, ok = store.Get(GetValueID("after"))
+	assert.True(t, ok, "Record written after recovery was lost")
+}
+
+// TestLogStoreCompacts verifies that overwriting a key many times does not grow the log without bound.
+func TestLogStoreCompacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store, err := NewLogStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+
+	id := GetValueID("overwritten")
+	for i := 0; i < 2*logCompactThreshold; i++ {
+		assert.NoError(t, store.Put(*NewStore().NewEntry(id, []byte("value"))))
+	}
+	assert.LessOrEqual(t, store.records, logCompactThreshold+1)
+	// Written to the compacted log, not the one it replaced
+	assert.NoError(t, store.Put(*NewStore().NewEntry(GetValueID("after"), []byte("value"))))
+
+	reopened, err := NewLogStore(path)
+	assert.NoError(t, err)
+	defer reopened.Close()
+	assert.Equal(t, 2, reopened.Stats().Entries)
+}
+
+// TestLogStoreClosed verifies that writes to a closed log fail instead of being lost silently.
+func TestLogStoreClosed(t *testing.T) {
+	store, err := NewLogStore(filepath.Join(t.TempDir(), "values.log"))
+	assert.NoError(t, err)
+	assert.NoError(t, store.Close())
+
+	_, err = NewDataStore(store).Insert(GetValueID("closed"), []byte("closed"), time.Hour)
+	assert.Error(t, err)
+}
+
+// TestLogStoreBinary verifies that binary values are recovered byte for byte.
+func TestLogStoreBinary(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "values.log")
+	store, err := NewLogStore(path)
+	assert.NoError(t, err)
+	binary := []byte{0x00, 0xff, 0xfe, '\n', 0x80}
+	assert.True(t, NewDataStore(store).Store(GetValueID("binary"), binary))
+	assert.NoError(t, store.Close())
+
+	store, err = NewLogStore(path)
+	assert.NoError(t, err)
+	defer store.Close()
+	val, _ := NewDataStore(store).GetEntry(GetValueID("binary"))
+	assert.Equal(t, binary, val)
+}
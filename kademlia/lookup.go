@@ -0,0 +1,327 @@
+package kademlia
+
+// This file contains the iterative lookup procedure from the kademlia paper.
+// A shortlist of candidates sorted by XOR distance to the target is kept,
+// ALPHA queries are in flight at any time, and the lookup ends once the
+// k closest candidates that have not failed have all responded.
+
+import (
+	"context"
+	"errors"
+	"fmt"
+	"slices"
+	"sort"
+	"sync"
+	"time"
+)
+
+// State of a candidate in a lookup shortlist
+const (
+	LOOKUP_UNQUERIED = iota
+	LOOKUP_INFLIGHT
+	LOOKUP_RESPONDED
+	LOOKUP_FAILED
+)
+
+// Called by the lookup for every candidate that is queried.
+// Returns the contacts the candidate knows of that are close to the target,
+// and stop = true if the lookup should end right away (e.g. a value was found).
+type LookupQuery func(ctx context.Context, contact Contact) (contacts []Contact, stop bool, err error)
+
+type lookupCandidate struct {
+	contact Contact
+	state   int
+}
+
+// Reply of a single query, sent back to the lookup loop
+type lookupReply struct {
+	candidate *lookupCandidate
+	contacts  []Contact
+	stop      bool
+	err       error
+}
+
+// Candidates of a lookup, sorted by distance to target
+type shortlist struct {
+	target     *KademliaID
+	me         *KademliaID
+	candidates []*lookupCandidate
+	seen       map[KademliaID]bool
+}
+
+func newShortlist(target *KademliaID, me *KademliaID) *shortlist {
+	return &shortlist{target: target, me: me, seen: make(map[KademliaID]bool)}
+}
+
+// Add contacts not seen before to the shortlist, keeping it sorted by distance.
+// This node itself is never added.
+func (sl *shortlist) add(contacts []Contact) {
+	for _, c := range contacts {
+		if c.ID == nil || c.ID.Equals(sl.me) || sl.seen[*c.ID] {
+			continue
+		}
+		sl.seen[*c.ID] = true
+		c.CalcDistance(sl.target)
+		sl.candidates = append(sl.candidates, &lookupCandidate{c, LOOKUP_UNQUERIED})
+	}
+	sort.SliceStable(sl.candidates, func(i, j int) bool {
+		return sl.candidates[i].contact.Less(&sl.candidates[j].contact)
+	})
+}
+
+// Returns the closest unqueried candidate among the k closest that have not failed,
+// or nil if all of them have been queried.
+func (sl *shortlist) nextUnqueried(k int) *lookupCandidate {
+	n := 0
+	for _, c := range sl.candidates {
+		if c.state == LOOKUP_FAILED {
+			continue
+		}
+		if n >= k {
+			break
+		}
+		if c.state == LOOKUP_UNQUERIED {
+			return c
+		}
+		n++
+	}
+	return nil
+}
+
+// Returns the k closest candidates that have responded.
+func (sl *shortlist) closest(k int) []Contact {
+	var ret []Contact
+	for _, c := range sl.candidates {
+		if len(ret) >= k {
+			break
+		}
+		if c.state == LOOKUP_RESPONDED {
+			ret = append(ret, c.contact)
+		}
+	}
+	return ret
+}
+
+// Run an iterative lookup for target, seeded from the routing table, calling query for every candidate.
+// Returns the k closest contacts that responded, sorted by distance to target.
+// If ctx ends before the lookup has converged, the closest contacts so far are returned with the context error.
+// Queries still in flight when the lookup returns are cancelled.
+func (network *Network) IterativeLookup(ctx context.Context, target *KademliaID, query LookupQuery) ([]Contact, error) {
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+
+	network.routing_table.TouchBucket(target)
+	sl := newShortlist(target, network.routing_table.me.ID)
+	sl.add(network.routing_table.FindClosestContacts(target, PARAM_K))
+	if len(sl.candidates) == 0 {
+		return nil, ErrNoContacts
+	}
+
+	// Buffered so that queries still in flight never block when the lookup returns early
+	replies := make(chan lookupReply, ALPHA)
+	inflight := 0
+	for {
+		for inflight < ALPHA {
+			c := sl.nextUnqueried(PARAM_K)
+			if c == nil {
+				break
+			}
+			c.state = LOOKUP_INFLIGHT
+			inflight++
+			go func(c *lookupCandidate) {
+				contacts, stop, err := query(ctx, c.contact)
+				replies <- lookupReply{c, contacts, stop, err}
+			}(c)
+		}
+
+		if inflight == 0 {
+			return sl.closest(PARAM_K), nil
+		}
+
+		select {
+		case reply := <-replies:
+			inflight--
+			if reply.err != nil {
+				reply.candidate.state = LOOKUP_FAILED
+				if errors.Is(reply.err, ErrRPCTimeout) {
+					network.MarkUnresponsive(reply.candidate.contact)
+				}
+				continue
+			}
+			reply.candidate.state = LOOKUP_RESPONDED
+			if reply.stop {
+				return sl.closest(PARAM_K), nil
+			}
+			sl.add(reply.contacts)
+
+		case <-ctx.Done():
+			return sl.closest(PARAM_K), ctx.Err()
+		}
+	}
+}
+
+// Query a contact with a FINDCONTACT rpc for the given target, see LookupQuery.
+func (network *Network) findContactQuery(target *KademliaID) LookupQuery {
+	var params = make(byte_arr_list, 1)
+	params[0] = []byte(target.String())
+	return func(ctx context.Context, contact Contact) ([]Contact, bool, error) {
+		resp, err := network.SendAndWaitContext(ctx, contact.Address, RPC_FINDCONTACT, params, network.rpc_opts)
+		if err != nil {
+			return nil, false, err
+		}
+		if resp.Rpc != RESP_CONTACTS {
+			return nil, false, fmt.Errorf("unexpected response %x to FINDCONTACT", resp.Rpc)
+		}
+		contacts, err := ResponseContacts(resp)
+		return contacts, false, err
+	}
+}
+
+// Iterative node lookup; find the k closest nodes to target in the network.
+func (network *Network) NodeLookup(ctx context.Context, target *KademliaID) ([]Contact, error) {
+	return network.IterativeLookup(ctx, target, network.findContactQuery(target))
+}
+
+// Result of FindValue
+type FindValueResult struct {
+	Value    []byte
+	TTL      time.Duration // Time left until the value expires at Source
+	Source   Contact       // Node that served the value
+	CachedAt *Contact      // Closest node on the lookup path without the value, where it was cached
+	Contacts []Contact     // Closest contacts to the key found by the lookup
+	Rejected []Contact     // Nodes that served a value that does not match its content-addressed key, see FindValue
+}
+
+// Iterative value lookup; query the nodes closest to key with FINDVAL rpcs until one returns the value.
+// A value that matches a content-addressed key (see IsContentAddressed) ends the lookup, and the nodes
+// that served another value for that key are reported in Rejected. Any other value may be stored under a name,
+// so the lookup goes on in case a matching value turns up, and the first one found is returned if none does.
+// The value is then stored at the closest node that responded without it, so that popular keys spread out.
+// Returns ErrValueNotFound if the lookup converged without finding the value.
+func (network *Network) FindValue(ctx context.Context, key *KademliaID) (FindValueResult, error) {
+	return network.findValue(ctx, key, false)
+}
+
+// FindValue for a content-addressed key, that only accepts a value that matches key.
+// Returns ErrTamperedValue if only values that do not match were found.
+func (network *Network) FindContent(ctx context.Context, key *KademliaID) (FindValueResult, error) {
+	return network.findValue(ctx, key, true)
+}
+
+// A value served during a value lookup
+type servedValue struct {
+	value  []byte
+	ttl    time.Duration
+	source Contact
+}
+
+func (network *Network) findValue(ctx context.Context, key *KademliaID, content bool) (FindValueResult, error) {
+	var result FindValueResult
+	var found, unverified *servedValue // The first value that matches key, and the first one that does not
+	var rejected []Contact             // Nodes that served a value that does not match key
+	holders := make(map[KademliaID]bool)
+	var found_lock sync.Mutex
+
+	if val, ok := network.data_store.GetEntry(key); ok {
+		ttl, _ := network.data_store.GetTTL(key)
+		me := network.routing_table.me
+		if IsContentAddressed(key, val) {
+			return FindValueResult{Value: val, TTL: ttl, Source: me}, nil
+		}
+		unverified = &servedValue{val, ttl, me}
+		rejected = append(rejected, me)
+	}
+
+	var params = make(byte_arr_list, 1)
+	params[0] = []byte(key.String())
+	query := func(ctx context.Context, contact Contact) ([]Contact, bool, error) {
+		resp, err := network.SendAndWaitContext(ctx, contact.Address, RPC_FINDVAL, params, network.rpc_opts)
+		if err != nil {
+			return nil, false, err
+		}
+		switch resp.Rpc {
+		case RESP_VALFOUND:
+			if len(resp.Data) == 0 {
+				return nil, false, fmt.Errorf("%w: no value", ErrMalformedMessage)
+			}
+			served := &servedValue{resp.Data[0], ParseTTL(resp.Data, 1), contact}
+			found_lock.Lock()
+			defer found_lock.Unlock()
+			holders[*contact.ID] = true
+			if IsContentAddressed(key, served.value) {
+				if found == nil {
+					found = served
+				}
+				return nil, true, nil
+			}
+			rejected = append(rejected, contact)
+			if unverified == nil {
+				unverified = served
+			}
+			if content {
+				fmt.Printf("Lookup: Rejected value for %s from %s: %v\n", key.String(), contact.String(), ErrTamperedValue)
+				return nil, false, ErrTamperedValue
+			}
+			return nil, false, nil
+		case RESP_CONTACTS:
+			contacts, err := ResponseContacts(resp)
+			return contacts, false, err
+		default:
+			return nil, false, fmt.Errorf("unexpected response %x to FINDVAL", resp.Rpc)
+		}
+	}
+
+	contacts, err := network.IterativeLookup(ctx, key, query)
+
+	// Queries cancelled by the end of the lookup may still be returning, hence the lock
+	found_lock.Lock()
+	result.Contacts = contacts
+	served := found
+	if served == nil && !content {
+		served = unverified
+	}
+	if served == nil || found != nil {
+		result.Rejected = slices.Clone(rejected)
+	}
+	// Caching step, the closest contact that responded without the value
+	var cache_at *Contact
+	for _, c := range contacts {
+		if !holders[*c.ID] {
+			cache_at = &c
+			break
+		}
+	}
+	found_lock.Unlock()
+
+	switch {
+	case served != nil:
+	case len(result.Rejected) > 0:
+		return result, fmt.Errorf("%w: served by %d nodes", ErrTamperedValue, len(result.Rejected))
+	case err != nil:
+		return result, err
+	default:
+		return result, ErrValueNotFound
+	}
+	result.Value = served.value
+	result.TTL = served.ttl
+	result.Source = served.source
+	fmt.Printf("Value for %s served by %s\n", key.String(), result.Source.String())
+	if cache_at != nil && !served.source.ID.Equals(network.routing_table.me.ID) {
+		if network.cacheValue(ctx, *cache_at, key, result.Value, result.TTL) {
+			result.CachedAt = cache_at
+		}
+	}
+	return result, nil
+}
+
+// Store a found value at a node on the lookup path until it expires at its source,
+// returns true if the node stored it.
+func (network *Network) cacheValue(ctx context.Context, contact Contact, key *KademliaID, value []byte, ttl time.Duration) bool {
+	resp, err := network.SendAndWaitContext(ctx, contact.Address, RPC_STORE, storeParams(key, value, ttl, network.peerCaps(contact.Address)), network.rpc_opts)
+	if err != nil {
+		fmt.Printf("Caching %s at %s failed: %v\n", key.String(), contact.String(), err)
+		return false
+	}
+	fmt.Printf("Cached %s at %s\n", key.String(), contact.String())
+	return resp.Rpc == RESP_STORE_OK
+}
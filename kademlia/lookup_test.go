@@ -0,0 +1,192 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestShortlistSorted verifies that the shortlist is sorted by distance and skips duplicates and self.
+func TestShortlistSorted(t *testing.T) {
+	me := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+	target := NewKademliaID("0000000000000000000000000000000000000000")
+	sl := newShortlist(target, me)
+
+	sl.add([]Contact{
+		NewContact(NewKademliaID("3000000000000000000000000000000000000000"), "localhost:8003"),
+		NewContact(NewKademliaID("1000000000000000000000000000000000000000"), "localhost:8001"),
+		NewContact(me, "localhost:8000"),
+	})
+	sl.add([]Contact{
+		NewContact(NewKademliaID("2000000000000000000000000000000000000000"), "localhost:8002"),
+		NewContact(NewKademliaID("1000000000000000000000000000000000000000"), "localhost:8001"),
+	})
+
+	assert.Equal(t, 3, len(sl.candidates), "Expected duplicates and self to be skipped")
+	for i, addr := range []string{"localhost:8001", "localhost:8002", "localhost:8003"} {
+		assert.Equal(t, addr, sl.candidates[i].contact.Address)
+	}
+}
+
+// TestShortlistNextUnqueried verifies that failed candidates make room for farther ones within k.
+func TestShortlistNextUnqueried(t *testing.T) {
+	target := NewKademliaID("0000000000000000000000000000000000000000")
+	sl := newShortlist(target, NewKademliaID("FFFFFFFF00000000000000000000000000000000"))
+	sl.add([]Contact{
+		NewContact(NewKademliaID("1000000000000000000000000000000000000000"), "localhost:8001"),
+		NewContact(NewKademliaID("2000000000000000000000000000000000000000"), "localhost:8002"),
+		NewContact(NewKademliaID("3000000000000000000000000000000000000000"), "localhost:8003"),
+	})
+
+	sl.candidates[0].state = LOOKUP_RESPONDED
+	sl.candidates[1].state = LOOKUP_INFLIGHT
+	assert.Nil(t, sl.nextUnqueried(2), "Expected no candidate among the 2 closest")
+
+	sl.candidates[1].state = LOOKUP_FAILED
+	next := sl.nextUnqueried(2)
+	assert.NotNil(t, next)
+	assert.Equal(t, "localhost:8003", next.contact.Address)
+
+	next.state = LOOKUP_RESPONDED
+	closest := sl.closest(PARAM_K)
+	assert.Equal(t, 2, len(closest), "Expected only responded candidates")
+}
+
+// TestNodeLookup verifies that a lookup finds nodes that are only known by other nodes.
+func TestNodeLookup(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19120", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19121", NewMemoryStore())
+	n3 := NewNetwork("127.0.0.1", "19122", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	go n3.Listen()
+
+	// n1 only knows n2, which only knows n3
+	n1.routing_table.AddContact(n2.routing_table.me)
+	n2.routing_table.AddContact(n3.routing_table.me)
+
+	contacts, err := n1.NodeLookup(context.Background(), n3.routing_table.me.ID)
+	assert.Nil(t, err)
+	assert.Equal(t, 2, len(contacts))
+	assert.True(t, contacts[0].ID.Equals(n3.routing_table.me.ID), "Expected the target to be the closest contact")
+}
+
+// TestLookupCancelsQueries verifies that queries still in flight are cancelled once a lookup stops early.
+func TestLookupCancelsQueries(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19243", NewMemoryStore())
+	first := NewContact(NewRandomKademliaID(), "127.0.0.1:19244")
+	network.routing_table.AddContact(first)
+	for i := 0; i < ALPHA; i++ {
+		network.routing_table.AddContact(NewContact(NewRandomKademliaID(), "127.0.0.1:19244"))
+	}
+
+	cancelled := make(chan struct{}, ALPHA)
+	query := func(ctx context.Context, contact Contact) ([]Contact, bool, error) {
+		if contact.ID.Equals(first.ID) {
+			return nil, true, nil
+		}
+		<-ctx.Done()
+		cancelled <- struct{}{}
+		return nil, false, ctx.Err()
+	}
+	_, err := network.IterativeLookup(context.Background(), first.ID, query)
+	assert.NoError(t, err)
+	for i := 0; i < ALPHA-1; i++ {
+		select {
+		case <-cancelled:
+		case <-time.After(time.Second):
+			t.Fatal("Expected the queries in flight to be cancelled")
+		}
+	}
+}
+
+// TestFindValueCaches verifies that a value lookup reports the serving node and caches the value on the path.
+func TestFindValueCaches(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19123", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19124", NewMemoryStore())
+	n3 := NewNetwork("127.0.0.1", "19125", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	go n3.Listen()
+
+	n1.routing_table.AddContact(n2.routing_table.me)
+	n2.routing_table.AddContact(n3.routing_table.me)
+	key := GetValueID("cached")
+	n3.data_store.Store(key, []byte("value"))
+
+	result, err := n1.FindValue(context.Background(), key)
+	assert.Nil(t, err)
+	assert.Equal(t, "value", string(result.Value))
+	assert.True(t, result.Source.ID.Equals(n3.routing_table.me.ID), "Expected the value to be served by n3")
+	assert.NotNil(t, result.CachedAt)
+	assert.True(t, result.CachedAt.ID.Equals(n2.routing_table.me.ID), "Expected the value to be cached at n2")
+	assert.True(t, n2.data_store.EntryExists(key))
+
+	_, err = n1.FindValue(context.Background(), GetValueID("missing"))
+	assert.ErrorIs(t, err, ErrValueNotFound)
+}
+
+// TestFindContentRejectsTampered verifies that a value that does not match its key is rejected,
+// and that the lookup falls back to another node holding the real value.
+func TestFindContentRejectsTampered(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19240", NewMemoryStore())
+	tampered := NewNetwork("127.0.0.1", "19241", NewMemoryStore())
+	honest := NewNetwork("127.0.0.1", "19242", NewMemoryStore())
+	go n1.Listen()
+	go tampered.Listen()
+	go honest.Listen()
+
+	value := []byte("content")
+	key := GetDataID(value)
+	tampered.data_store.Store(key, []byte("tampered"))
+	n1.routing_table.AddContact(tampered.routing_table.me)
+
+	result, err := n1.FindContent(context.Background(), key)
+	assert.ErrorIs(t, err, ErrTamperedValue)
+	assert.Len(t, result.Rejected, 1)
+	assert.True(t, result.Rejected[0].ID.Equals(tampered.routing_table.me.ID))
+
+	honest.data_store.Store(key, value)
+	n1.routing_table.AddContact(honest.routing_table.me)
+	result, err = n1.FindContent(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, value, result.Value)
+	assert.True(t, result.Source.ID.Equals(honest.routing_table.me.ID))
+}
+
+// TestFindValueRejectsTampered verifies that a plain value lookup prefers a value that matches its content-addressed key,
+// reports the node that served another value, and only caches the matching value.
+func TestFindValueRejectsTampered(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19245", NewMemoryStore())
+	tampered := NewNetwork("127.0.0.1", "19246", NewMemoryStore())
+	mid := NewNetwork("127.0.0.1", "19247", NewMemoryStore())
+	honest := NewNetwork("127.0.0.1", "19248", NewMemoryStore())
+	for _, n := range []*Network{n1, tampered, mid, honest} {
+		go n.Listen()
+	}
+
+	value := []byte("content")
+	key := GetDataID(value)
+	tampered.data_store.Store(key, []byte("tampered"))
+	honest.data_store.Store(key, value)
+	// The honest node is only found through mid, after the tampered node has answered
+	n1.routing_table.AddContact(tampered.routing_table.me)
+	n1.routing_table.AddContact(mid.routing_table.me)
+	mid.routing_table.AddContact(honest.routing_table.me)
+
+	result, err := n1.FindValue(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, value, result.Value)
+	assert.True(t, result.Source.ID.Equals(honest.routing_table.me.ID))
+	assert.Len(t, result.Rejected, 1)
+	assert.NotNil(t, result.CachedAt)
+	assert.True(t, result.CachedAt.ID.Equals(mid.routing_table.me.ID), "Expected the value to be cached at the node without it")
+	cached, _ := mid.data_store.GetEntry(key)
+	assert.Equal(t, value, cached)
+
+	got, _, err := n1.Get(context.Background(), key)
+	assert.NoError(t, err)
+	assert.Equal(t, value, got)
+}
@@ -0,0 +1,65 @@
+package kademlia
+
+import "sync"
+
+// In-memory Store backend, indexed by key.
+// Guarded by lock, since handlers and the sweeper run in their own goroutines.
+type MemoryStore struct {
+	entries map[KademliaID]Entry
+	bytes   int64
+	lock    sync.RWMutex
+}
+
+func NewMemoryStore() *MemoryStore {
+	return &MemoryStore{entries: make(map[KademliaID]Entry)}
+}
+
+func (store *MemoryStore) Put(entry Entry) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if old, ok := store.entries[*entry.key]; ok {
+		store.bytes -= int64(len(old.value))
+	}
+	store.entries[*entry.key] = entry
+	store.bytes += int64(len(entry.value))
+	return nil
+}
+
+func (store *MemoryStore) Get(key *KademliaID) (Entry, bool) {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	e, ok := store.entries[*key]
+	return e, ok
+}
+
+func (store *MemoryStore) Delete(key *KademliaID) error {
+	store.lock.Lock()
+	defer store.lock.Unlock()
+
+	if old, ok := store.entries[*key]; ok {
+		store.bytes -= int64(len(old.value))
+		delete(store.entries, *key)
+	}
+	return nil
+}
+
+func (store *MemoryStore) Iterate(fn func(entry Entry) bool) error {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	for _, e := range store.entries {
+		if !fn(e) {
+			break
+		}
+	}
+	return nil
+}
+
+func (store *MemoryStore) Stats() StoreStats {
+	store.lock.RLock()
+	defer store.lock.RUnlock()
+
+	return StoreStats{Entries: len(store.entries), Bytes: store.bytes}
+}
@@ -1,34 +1,140 @@
 package kademlia
 
 import (
+	"context"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"os"
-	"sort"
-  "time"
+	"strings"
+	"time"
 )
 
-// Send a request to the bootstrap node (init_addr) to join the network.
-// This is done by requesting a self-lookup to the bootstrap node
-func (network *Network) JoinNetwork(init_addr string) {
-	fmt.Println("Self-lookup request sent")
-	bootstrap_id := NewKademliaID(os.Getenv("BOOTSTRAP_NODE_ID"))
-	network.routing_table.AddContact(NewContact(bootstrap_id, init_addr))
+// Join the network through the first reachable bootstrap node in init_addrs, trying them in turn.
+// Every one of them is trusted as a bootstrap node, see sign.go, also those that were not reachable now.
+// Returns the number of contacts learned, or the errors of every attempt if none of them succeeded.
+func (network *Network) JoinNetworkAny(init_addrs []string) (int, error) {
+	for _, addr := range init_addrs {
+		network.trustBootstrap(addr)
+	}
+	var errs []error
+	for _, addr := range init_addrs {
+		learned, err := network.JoinNetwork(addr)
+		if err == nil {
+			return learned, nil
+		}
+		fmt.Printf("Join through %s failed: %v\n", addr, err)
+		errs = append(errs, err)
+	}
+	if len(errs) == 0 {
+		return 0, ErrNoContacts
+	}
+	return 0, errors.Join(errs...)
+}
+
+// Join the network through the bootstrap node (init_addr), following the join procedure of the paper:
+// add the bootstrap node as a contact, perform a self-lookup, then refresh every bucket
+// farther away than the closest neighbour found.
+// The id of the bootstrap node does not need to be known, it is learned from its first response,
+// and init_addr is trusted to send an id that is not derived from its key, see sign.go.
+// Returns the number of contacts learned, or ErrBootstrapUnreachable if the bootstrap node did not respond,
+// or ErrBootstrapIsSelf if init_addr is this node, e.g. when a bootstrap node joins through the list of all of them.
+func (network *Network) JoinNetwork(init_addr string) (int, error) {
+	ctx := context.Background()
+	known := network.routing_table.Len()
+	network.trustBootstrap(init_addr)
 
 	var params = make(byte_arr_list, 1)
-	target_node_id := network.routing_table.me.ID.String()
-	params[0] = []byte(target_node_id)
-	resp := network.SendAndWait(init_addr, RPC_NODELOOKUP, params)
-
-	// Send ping to nodes
-	nodes := NetDeserialize[[]Contact](resp.Data[0])
-	fmt.Println("NODES:")
-	fmt.Printf("%+v\n", nodes)
+	params[0] = []byte(network.routing_table.me.ID.String())
+	resp, err := network.SendAndWait(init_addr, RPC_FINDCONTACT, params)
+	if err != nil {
+		return 0, fmt.Errorf("%w: %s: %v", ErrBootstrapUnreachable, init_addr, err)
+	}
+	bootstrap := NewContact(NewKademliaID(resp.Src_node_id), init_addr)
+	if bootstrap.ID.Equals(network.routing_table.me.ID) {
+		return 0, fmt.Errorf("%w: %s", ErrBootstrapIsSelf, init_addr)
+	}
+	fmt.Printf("Bootstrap node %s\n", bootstrap.String())
+	network.AddContact(bootstrap)
+
+	fmt.Println("Self-lookup request sent")
+	nodes, err := network.NodeLookup(ctx, network.routing_table.me.ID)
+	if err != nil {
+		return 0, err
+	}
+	if len(nodes) == 0 {
+		return 0, fmt.Errorf("%w: %s", ErrBootstrapUnreachable, init_addr)
+	}
 	for _, node := range nodes {
-		if node.ID.Equals(network.routing_table.me.ID) {
-			continue
+		network.AddContact(node)
+	}
+
+	// Buckets with a lower index cover ids farther away from this node
+	closest_index := network.routing_table.getBucketIndex(nodes[0].ID)
+	for index := 0; index < closest_index; index++ {
+		target := network.routing_table.RandomIDInBucket(index)
+		if _, err := network.NodeLookup(ctx, target); err != nil {
+			fmt.Printf("Join: Refresh of bucket %d failed: %v\n", index, err)
 		}
-		network.routing_table.AddContact(node)
-		network.SendPing(node.ID.String())
+	}
+
+	learned := network.routing_table.Len() - known
+	fmt.Printf("Joined network through %s, learned %d contacts\n", init_addr, learned)
+	return learned, nil
+}
+
+// Add a contact that has been seen to the routing table.
+// If its bucket is full, the least-recently seen contact is pinged in the background
+// and only evicted in favour of the new contact if it does not respond.
+func (network *Network) AddContact(contact Contact) {
+	lru := network.routing_table.AddContact(contact)
+	if lru == nil {
+		return
+	}
+
+	network.evict_lock.Lock()
+	defer network.evict_lock.Unlock()
+	if network.evicting[*lru.ID] {
+		return
+	}
+	network.evicting[*lru.ID] = true
+	go network.checkEviction(*lru, contact)
+}
+
+// Ping the least-recently seen contact of a full bucket.
+// Keep it if it responds, otherwise evict it and promote the freshest contact
+// of the replacement cache, where the newcomer has been put.
+func (network *Network) checkEviction(lru Contact, newcomer Contact) {
+	defer func() {
+		network.evict_lock.Lock()
+		delete(network.evicting, *lru.ID)
+		network.evict_lock.Unlock()
+	}()
+
+	var params = make(byte_arr_list, 1)
+	params[0] = []byte(lru.ID.String())
+	resp, err := network.SendAndWaitWithOptions(lru.Address, RPC_PING, params, network.ping_opts)
+	if err == nil && resp.Rpc == RESP_PING_OK {
+		fmt.Printf("Kept %s in full bucket, %s stays in the replacement cache\n", lru.String(), newcomer.String())
+		network.routing_table.AddContact(lru)
+		return
+	}
+
+	fmt.Printf("Evicted unresponsive %s\n", lru.String())
+	network.routing_table.RemoveContact(lru.ID)
+}
+
+// Start removing expired values from the store in the background, see Store.StartSweeper.
+func (network *Network) StartStoreSweeper(interval time.Duration) {
+	network.data_store.StartSweeper(interval)
+}
+
+// Count a failed RPC to a contact in the routing table.
+// Once the contact is stale it is replaced from the replacement cache of its bucket,
+// so that later lookups move on to other nodes.
+func (network *Network) MarkUnresponsive(contact Contact) {
+	if network.routing_table.MarkFailed(contact.ID) {
+		fmt.Printf("Replaced stale contact %s\n", contact.String())
 	}
 }
 
@@ -53,10 +159,12 @@ func (network *Network) ManagePing(aid *AuthID, req_addr string, target_node_id
 		return
 	}
 
+	// A copy of me, since the distance is written into it and handlers run concurrently
+	me := network.routing_table.me
 	closest := closest_contacts[0]
-	network.routing_table.me.CalcDistance(target)
+	me.CalcDistance(target)
 	closest.CalcDistance(target)
-	if network.routing_table.me.Less(&closest) {
+	if me.Less(&closest) {
 		fmt.Printf("No closer node found")
 		response := []byte(fmt.Sprintf("No closer node found"))
 		network.SendResponse(aid, req_addr, RESP_PING_FAIL, response)
@@ -65,35 +173,36 @@ func (network *Network) ManagePing(aid *AuthID, req_addr string, target_node_id
 
 	var response = make(byte_arr_list, 1)
 	response[0] = []byte(target_node_id)
-	resp := network.SendAndWait(closest.Address, RPC_PING, response)
+	resp, err := network.SendAndWait(closest.Address, RPC_PING, response)
+	if err != nil {
+		network.MarkUnresponsive(closest)
+		network.SendResponse(aid, req_addr, RESP_PING_FAIL, []byte(err.Error()))
+		return
+	}
 	network.SendResponse(aid, req_addr, resp.Rpc, nil)
 }
 
-// Same as PING but send additional metadata that gets stored. Send an OK to original client.
-func (network *Network) ManageStore(aid *AuthID, req_addr string, value_id string, value string) {
+// Store the value at this node for ttl and send an OK to the original client.
+// The client is responsible for picking the nodes to store at (see Put and the caching step of FindValue),
+// so the value is never forwarded. Storing a value again extends its expiry.
+// A value that does not match its key is stored and acknowledged like any other, since a key made from
+// a name looks no different from a content-addressed one, but a value that matches replaces it (see DataStore.Insert).
+func (network *Network) ManageStore(aid *AuthID, req_addr string, value_id string, value []byte, ttl time.Duration) {
 	target := NewKademliaID(value_id)
-	closest := network.routing_table.FindClosestContacts(target, 1)[0]
-	network.routing_table.me.CalcDistance(target)
-	closest.CalcDistance(target)
-	if network.routing_table.me.Less(&closest) {
-		if network.data_store.EntryExists(target) {
-			fmt.Printf("Entry already exists: %s:%s, req from %s\n", value_id, value, req_addr)
-			network.SendResponse(aid, req_addr, RESP_STORE_EXISTS, nil)
-			return
-		}
-
-		fmt.Printf("Adding entry to store: %s:%s, req from %s\n", value_id, value, req_addr)
-		network.data_store.Store(target, value)
-		network.SendResponse(aid, req_addr, RESP_STORE_OK, nil)
+	stored, err := network.data_store.Insert(target, value, ttl)
+	if err != nil {
+		fmt.Printf("Storing entry failed: %s, req from %s: %v\n", value_id, req_addr, err)
+		network.SendResponse(aid, req_addr, RESP_STORE_FAIL, []byte(err.Error()))
+		return
+	}
+	if !stored {
+		fmt.Printf("Entry already exists: %s, req from %s\n", value_id, req_addr)
+		network.SendResponse(aid, req_addr, RESP_STORE_EXISTS, nil)
 		return
 	}
 
-	var params = make(byte_arr_list, 2)
-	params[0] = []byte(value_id)
-	params[1] = []byte(value)
-	response := network.SendAndWait(closest.Address, RPC_STORE, params)
-	network.SendResponse(aid, req_addr, response.Rpc, nil)
-
+	fmt.Printf("Added entry to store: %s (%d bytes, ttl %v), req from %s\n", value_id, len(value), ttl, req_addr)
+	network.SendResponse(aid, req_addr, RESP_STORE_OK, nil)
 }
 
 // Same as findnode, but if the target is node, return a value instead.
@@ -102,225 +211,145 @@ func (network *Network) ManageFindData(aid *AuthID, req_addr string, value_id st
 	closest_contacts := network.routing_table.FindClosestContacts(target, PARAM_K)
 	fmt.Printf("%+v\n", closest_contacts)
 
-	if network.data_store.EntryExists(target) {
+	if val, ok := network.data_store.GetEntry(target); ok {
 		fmt.Println("Value found")
-		val, _ := network.data_store.GetEntry(target)
-		network.SendResponse(aid, req_addr, RESP_VALFOUND, []byte(val))
+		ttl, _ := network.data_store.GetTTL(target)
+		resp := byte_arr_list{val}
+		if network.peerCaps(req_addr)&CAP_VALUE_TTL != 0 {
+			resp = append(resp, EncodeTTL(ttl))
+		}
+		network.SendResponseData(aid, req_addr, RESP_VALFOUND, resp)
 		return
 	}
 
-	contact_bytes := NetSerialize[[]Contact](closest_contacts)
 	fmt.Printf("Main listener: Sent response to: %s\n", req_addr)
-	network.SendResponse(aid, req_addr, RESP_CONTACTS, contact_bytes)
+	network.SendContacts(aid, req_addr, closest_contacts)
 }
 
 // Get k closest nodes from k-buckets and return
 func (network *Network) ManageFindContact(aid *AuthID, req_addr string, target_node_id string) {
 	target := NewKademliaID(target_node_id)
 	closest_contacts := network.routing_table.FindClosestContacts(target, PARAM_K)
-	contact_bytes := NetSerialize[[]Contact](closest_contacts)
 	fmt.Printf("Main listener: Sent response to: %s\n", req_addr)
-	network.SendResponse(aid, req_addr, RESP_CONTACTS, contact_bytes)
+	network.SendContacts(aid, req_addr, closest_contacts)
 }
 
+// Perform an iterative node lookup on behalf of the requester and return the k closest contacts.
 func (network *Network) ManageNodeLookup(aid *AuthID, req_addr string, target_node_id string) {
 	target := NewKademliaID(target_node_id)
-	closest := network.routing_table.FindClosestContacts(target, ALPHA)
-	var params = make(byte_arr_list, 1)
-	params[0] = []byte(target_node_id)
-
-	first_pass_ch := make(chan []Contact, ALPHA)
-	recursion_result := make(chan []Contact, ALPHA)
-	var shortlist []Contact
-
-	// First-pass: Send alpha requests and initiate second (recursive) step when they return
-	for _, c := range closest {
-		go func() {
-			resp := network.SendAndWait(c.Address, RPC_FINDCONTACT, params)
-			first_pass_ch <- NetDeserialize[[]Contact](resp.Data[0])
-			shortlist = append(shortlist, c)
-		}()
+	shortlist, err := network.NodeLookup(context.Background(), target)
+	if err != nil {
+		fmt.Printf("Node lookup for %s failed: %v\n", target_node_id, err)
 	}
 
-	// recursive case
-	for _, _ = range closest {
-		x := <-first_pass_ch
-		go func(unqueried []Contact) {
-			var ret []Contact
-			for len(unqueried) > 0 {
-				// prevent loop by sending FC to self
-				if !(unqueried[0].ID.Equals(network.routing_table.me.ID)) {
-					resp := network.SendAndWait(unqueried[0].Address, RPC_FINDCONTACT, params)
-
-					ret = append(ret, NetDeserialize[[]Contact](resp.Data[0])...)
-				}
-				unqueried = unqueried[1:]
-			}
-			recursion_result <- ret
-		}(x)
-	}
-
-	// Wait for recursion steps to finish
-	for _, _ = range closest {
-		res := <-recursion_result
-		sl := append(shortlist, res...)
-
-		var slp []*Contact
-
-		for _, n := range sl {
-			n.CalcDistance(target)
-			slp = append(slp, &n)
-		}
-
-		sort.Slice(slp, func(i, j int) bool {
-			return (*slp[i]).Less(slp[j])
-		})
+	network.SendContacts(aid, req_addr, shortlist)
+}
 
-		if len(sl) > PARAM_K {
-			shortlist = sl[:PARAM_K]
-		}
+// Respond with a RESP_CONTACTS holding the contacts in the binary contact list format, see wire.go.
+func (network *Network) SendContacts(aid *AuthID, req_addr string, contacts []Contact) {
+	contact_bytes, err := EncodeContacts(contacts)
+	if err != nil {
+		fmt.Printf("Encoding contacts for %s failed: %v\n", req_addr, err)
+		return
 	}
-
-	contact_bytes := NetSerialize[[]Contact](shortlist)
 	network.SendResponse(aid, req_addr, RESP_CONTACTS, contact_bytes)
 }
 
 // Send a PING RPC to the network and return the status message string.
+// Thin wrapper around Ping for the CLI.
 func (network *Network) SendPing(target_node_id string) string {
-	target := NewKademliaID(target_node_id)
-	if network.routing_table.me.ID.Equals(target) {
-		fmt.Println("Ping is this node")
+	err := network.Ping(context.Background(), NewKademliaID(target_node_id))
+	switch {
+	case err == nil:
 		return fmt.Sprintf("Ping response from %s\n", target_node_id)
-	}
-
-	closest_contacts := network.routing_table.FindClosestContacts(target, 1)
-	if len(closest_contacts) == 0 {
-		fmt.Println("No closest node found")
+	case errors.Is(err, ErrNoContacts):
 		return "No closest node found\n"
-	}
-
-	fmt.Printf("%+v\n", closest_contacts)
-
-	closest_node := closest_contacts[0]
-	var params = make(byte_arr_list, 1)
-	params[0] = []byte(target_node_id)
-	resp := network.SendAndWait(closest_node.Address, RPC_PING, params)
-
-	switch resp.Rpc {
-	case RESP_PING_OK:
-		return fmt.Sprintf("Ping response from %s\n", target_node_id)
-	case RESP_PING_FAIL:
-		return fmt.Sprintf("Ping fail; %s\n", resp.Data[0])
+	case errors.Is(err, ErrPingFailed):
+		return fmt.Sprintf("Ping fail; %s\n", strings.TrimPrefix(err.Error(), ErrPingFailed.Error()+": "))
 	default:
-		return fmt.Sprintf("ERR: %+v\n", resp)
+		return fmt.Sprintf("ERR: %v\n", err)
 	}
 }
 
-// Send a STORE RPC and return the status message string
+// Send a STORE RPC and return the status message string.
+// Thin wrapper around Put for the CLI.
 func (network *Network) SendStore(value_key string, value []byte) string {
-	target := NewKademliaID(value_key)
-	closest_contacts := network.routing_table.FindClosestContacts(target, 1)
-	if len(closest_contacts) == 0 {
-		fmt.Println("No closest node found")
+	res, err := network.Put(context.Background(), NewKademliaID(value_key), value)
+	switch {
+	case errors.Is(err, ErrNoContacts):
 		return "No closest node found\n"
-	}
-
-	/*
-		closest_node := closest_contacts[0]
-		network.routing_table.me.CalcDistance(target)
-		closest_node.CalcDistance(target)
-		if network.routing_table.me.Less(&closest_node) {
-			fmt.Printf("Adding entry to store: %s:%s, at self\n", target.String(), value)
-			network.data_store.Store(target, string(value))
-			return "Value has been stored in the network\n"
-
-				var params = make(byte_arr_list, 2)
-		params[0] = []byte(target.String())
-		params[1] = []byte(value)
-		resp := network.SendAndWait(closest_node.Address, RPC_STORE, params)
-		}*/
-	var fc_params = make(byte_arr_list, 2)
-	fc_params[0] = []byte(target.String())
-	node_msg := network.SendAndWait(network.routing_table.me.Address, RPC_NODELOOKUP, fc_params)
-	nodes := NetDeserialize[[]Contact](node_msg.Data[0])
-
-	var params = make(byte_arr_list, 2)
-	params[0] = []byte(target.String())
-	params[1] = []byte(value)
-	ch := make(chan NetworkMessage, 1)
-	for _, n := range nodes {
-		go func(node Contact) {
-			store_resp := network.SendAndWait(node.Address, RPC_STORE, params)
-			if store_resp.Rpc == RESP_STORE_OK {
-				ch <- store_resp
-			}
-		}(n)
-	}
-
-  time.AfterFunc(RPC_TIMEOUT, func() {
-    close(ch)
-  })
-
-	resp := <-ch
-
-	switch resp.Rpc {
-	case RESP_STORE_OK:
-		return "Value has been stored in the network\n"
-	case RESP_STORE_EXISTS:
+	case err != nil:
+		return fmt.Sprintf("ERR: %v\n", err)
+	case res.Exists:
 		return "Value already exists\n"
 	default:
-		return fmt.Sprintf("ERR: %+v\n", resp)
+		return fmt.Sprintf("Value has been stored in the network at %d of %d nodes\n", res.Replicas, res.Targets)
 	}
 }
 
-// Send a FINDVAL RPC and return the status message string
+// Send a FINDVAL RPC and return the status message string.
+// Thin wrapper around FindValue for the CLI, that also shows how long the value will live.
+// A value that would not fit on one line of text is shown in base64, see SendFindValueBase64.
 func (network *Network) SendFindValue(value_key string) string {
-	target := NewKademliaID(value_key)
-	if network.data_store.EntryExists(target) {
-		fmt.Println("Value found")
-		val, _ := network.data_store.GetEntry(target)
-		return val + "\n"
-	}
+	return network.findValueStatus(value_key, func(value []byte) (string, error) {
+		if !IsPrintable(value) {
+			return "Value (base64): " + base64.StdEncoding.EncodeToString(value), nil
+		}
+		return fmt.Sprintf("Value: %s", value), nil
+	})
+}
 
-	closest_contacts := network.routing_table.FindClosestContacts(target, 1)
-	if len(closest_contacts) == 0 {
-		fmt.Println("No closest node found")
-		return "No closest node found\n"
+// SendFindValue that always shows the value in base64, so that binary values survive the CLI.
+func (network *Network) SendFindValueBase64(value_key string) string {
+	return network.findValueStatus(value_key, func(value []byte) (string, error) {
+		return "Value (base64): " + base64.StdEncoding.EncodeToString(value), nil
+	})
+}
+
+// SendFindValue that writes the value byte for byte to the file at path instead of showing it.
+func (network *Network) SendFindValueToFile(value_key string, path string) string {
+	return network.findValueStatus(value_key, func(value []byte) (string, error) {
+		if err := os.WriteFile(path, value, 0644); err != nil {
+			return "", err
+		}
+		return fmt.Sprintf("Wrote %d bytes to %s", len(value), path), nil
+	})
+}
+
+// Find a value, fetching its chunks if needed, and return the status message string of the Send*Value functions.
+// show formats the value found.
+func (network *Network) findValueStatus(value_key string, show func(value []byte) (string, error)) string {
+	ctx := context.Background()
+	result, err := network.FindValue(ctx, NewKademliaID(value_key))
+	if err == nil {
+		result.Value, err = network.resolveValue(ctx, result.Value)
 	}
-	closest_node := closest_contacts[0]
-	var params = make(byte_arr_list, 1)
-	params[0] = []byte(target.String())
-	resp := network.SendAndWait(closest_node.Address, RPC_FINDVAL, params)
-
-	switch resp.Rpc {
-	case RESP_VALFOUND:
-		return fmt.Sprintf("Value: %s\n", resp.Data[0])
-	case RESP_CONTACTS:
-		return fmt.Sprintf("%s\n", ParseContactList(resp.Data[0]))
+	var status string
+	if err == nil {
+		status, err = show(result.Value)
+	}
+	switch {
+	case err == nil:
+		return fmt.Sprintf("%s, expires in %v\n", status, result.TTL.Round(time.Second))
+	case errors.Is(err, ErrNoContacts):
+		return "No closest node found\n"
+	case errors.Is(err, ErrValueNotFound):
+		return fmt.Sprintf("%s\n", FormatContactList(result.Contacts))
 	default:
-		return fmt.Sprintf("ERR: %+v\n", resp)
+		return fmt.Sprintf("ERR: %v\n", err)
 	}
 }
 
-// Send a FIND_NODE rpc and return the status message strong
+// Send a FIND_NODE rpc and return the status message strong.
+// Thin wrapper around FindNode for the CLI.
 func (network *Network) SendFindContact(addr string, target_node_id *KademliaID) string {
-	target := NewKademliaID(target_node_id.String())
-
-	closest_contacts := network.routing_table.FindClosestContacts(target, 1)
-	if len(closest_contacts) == 0 {
-		fmt.Println("No closest node found")
+	contacts, err := network.FindNode(context.Background(), target_node_id)
+	switch {
+	case err == nil:
+		return fmt.Sprintf("%s\n", FormatContactList(contacts))
+	case errors.Is(err, ErrNoContacts):
 		return "No closest node found\n"
-	}
-
-	closest_node := closest_contacts[0]
-	var params = make(byte_arr_list, 1)
-	params[0] = []byte(target.String())
-	resp := network.SendAndWait(closest_node.Address, RPC_FINDVAL, params)
-
-	switch resp.Rpc {
-	case RESP_CONTACTS:
-		return fmt.Sprintf("%s\n", ParseContactList(resp.Data[0]))
 	default:
-		return fmt.Sprintf("ERR: %+v\n", resp)
+		return fmt.Sprintf("ERR: %v\n", err)
 	}
 }
@@ -1 +1,267 @@
 package kademlia
+
+import (
+	"crypto/ed25519"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// Fill the bucket of network that holds ids starting with a 0 bit, with the given contact at the back.
+func fillFarBucket(network *Network, lru Contact) {
+	network.routing_table.AddContact(lru)
+	for i := 1; i < bucketSize; i++ {
+		network.routing_table.AddContact(NewContact(newFarKademliaID(), "127.0.0.1:1"))
+	}
+}
+
+// Returns true if the contact with id is in the routing table of network.
+func hasContact(network *Network, id *KademliaID) bool {
+	closest := network.routing_table.FindClosestContacts(id, 1)
+	return len(closest) == 1 && closest[0].ID.Equals(id)
+}
+
+// Returns a node key whose derived id starts with a 0 bit, so that the node lands in the bucket filled by fillFarBucket.
+func farNodeKey() ed25519.PrivateKey {
+	for {
+		key := GenerateNodeKey()
+		if NewKademliaIDFromPublicKey(key.Public().(ed25519.PublicKey))[0]&0x80 == 0 {
+			return key
+		}
+	}
+}
+
+// Wait until every eviction ping of network has been answered or has timed out.
+func waitEvictions(t *testing.T, network *Network) {
+	deadline := time.Now().Add(5 * time.Second)
+	for {
+		network.evict_lock.Lock()
+		pending := len(network.evicting)
+		network.evict_lock.Unlock()
+		if pending == 0 {
+			return
+		}
+		if time.Now().After(deadline) {
+			t.Fatal("Expected the eviction ping to finish")
+		}
+		time.Sleep(10 * time.Millisecond)
+	}
+}
+
+// TestEvictionKeepsLiveContact verifies that a responsive least-recently seen contact is kept in a full bucket.
+func TestEvictionKeepsLiveContact(t *testing.T) {
+	t.Setenv("IS_BOOTSTRAP_NODE", "true")
+	t.Setenv("BOOTSTRAP_NODE_ID", "FFFFFFFF00000000000000000000000000000000")
+	network := NewNetwork("127.0.0.1", "19130", NewMemoryStore())
+	network.ping_opts = RPCOptions{Timeout: 200 * time.Millisecond, Retries: 0}
+	t.Setenv("IS_BOOTSTRAP_NODE", "false")
+	live := NewNetworkWithKey(farNodeKey(), "127.0.0.1", "19131", NewMemoryStore())
+	// The id of network is configured, so live only accepts its ping from a bootstrap address
+	live.trustBootstrap("127.0.0.1:19130")
+	go network.Listen()
+	go live.Listen()
+
+	fillFarBucket(network, live.routing_table.me)
+	newcomer := NewContact(newFarKademliaID(), "127.0.0.1:1")
+	network.AddContact(newcomer)
+
+	waitEvictions(t, network)
+	assert.True(t, hasContact(network, live.routing_table.me.ID), "Expected live contact to be kept")
+	assert.False(t, hasContact(network, newcomer.ID), "Expected newcomer to be dropped")
+}
+
+// TestEvictionReplacesDeadContact verifies that an unresponsive least-recently seen contact is evicted.
+func TestEvictionReplacesDeadContact(t *testing.T) {
+	t.Setenv("IS_BOOTSTRAP_NODE", "true")
+	t.Setenv("BOOTSTRAP_NODE_ID", "FFFFFFFF00000000000000000000000000000000")
+	network := NewNetwork("127.0.0.1", "19132", NewMemoryStore())
+	network.ping_opts = RPCOptions{Timeout: 50 * time.Millisecond, Retries: 0}
+	go network.Listen()
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:19133")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+	dead := NewContact(newFarKademliaID(), "127.0.0.1:19133")
+
+	fillFarBucket(network, dead)
+	newcomer := NewContact(newFarKademliaID(), "127.0.0.1:1")
+	network.AddContact(newcomer)
+
+	waitEvictions(t, network)
+	assert.False(t, hasContact(network, dead.ID), "Expected dead contact to be evicted")
+	assert.True(t, hasContact(network, newcomer.ID), "Expected newcomer to take its place")
+}
+
+// TestConcurrentPings verifies that PING handlers comparing distances to different targets do not share state.
+func TestConcurrentPings(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19134", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19135", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	n1.routing_table.AddContact(n2.routing_table.me)
+
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func() {
+			defer wg.Done()
+			n1.ManagePing(GenerateRandomAuthID(), "127.0.0.1:1", NewRandomKademliaID().String())
+		}()
+	}
+	wg.Wait()
+}
+
+// TestJoinNetwork verifies that joining nodes learn about each other through the bootstrap node.
+func TestJoinNetwork(t *testing.T) {
+	bootstrap_id := "FFFFFFFF00000000000000000000000000000000"
+	t.Setenv("IS_BOOTSTRAP_NODE", "true")
+	t.Setenv("BOOTSTRAP_NODE_ID", bootstrap_id)
+	bootstrap := NewNetwork("127.0.0.1", "19150", NewMemoryStore())
+	t.Setenv("IS_BOOTSTRAP_NODE", "false")
+	go bootstrap.Listen()
+
+	var nodes []*Network
+	for i := 0; i < 4; i++ {
+		node := NewNetwork("127.0.0.1", fmt.Sprintf("%d", 19151+i), NewMemoryStore())
+		go node.Listen()
+		learned, err := node.JoinNetwork("127.0.0.1:19150")
+		assert.Nil(t, err)
+		assert.Equal(t, i+1, learned, "Expected the bootstrap node and every earlier node to be learned")
+		nodes = append(nodes, node)
+	}
+	assert.True(t, hasContact(nodes[0], nodes[3].routing_table.me.ID), "Expected the first node to learn about later ones")
+}
+
+// TestJoinNetworkUnreachable verifies that joining through a silent bootstrap node returns an error.
+func TestJoinNetworkUnreachable(t *testing.T) {
+	t.Setenv("BOOTSTRAP_NODE_ID", "FFFFFFFF00000000000000000000000000000000")
+	network := NewNetwork("127.0.0.1", "19158", NewMemoryStore())
+	network.rpc_opts = RPCOptions{Timeout: 50 * time.Millisecond, Retries: 1, Backoff: 10 * time.Millisecond}
+	go network.Listen()
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:19159")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	learned, err := network.JoinNetwork("127.0.0.1:19159")
+	assert.ErrorIs(t, err, ErrBootstrapUnreachable)
+	assert.Equal(t, 0, learned)
+}
+
+// TestJoinNetworkAny verifies that an unreachable bootstrap node is skipped, and that the id of the
+// bootstrap node is learned from its response instead of the environment.
+func TestJoinNetworkAny(t *testing.T) {
+	t.Setenv("IS_BOOTSTRAP_NODE", "true")
+	t.Setenv("BOOTSTRAP_NODE_ID", "EEEEEEEE00000000000000000000000000000000")
+	bootstrap := NewNetwork("127.0.0.1", "19160", NewMemoryStore())
+	t.Setenv("IS_BOOTSTRAP_NODE", "false")
+	t.Setenv("BOOTSTRAP_NODE_ID", "")
+	go bootstrap.Listen()
+
+	silent, err := net.ListenPacket("udp", "127.0.0.1:19161")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer silent.Close()
+
+	network := NewNetwork("127.0.0.1", "19162", NewMemoryStore())
+	network.rpc_opts = RPCOptions{Timeout: 50 * time.Millisecond, Retries: 0}
+	go network.Listen()
+
+	learned, err := network.JoinNetworkAny([]string{"127.0.0.1:19161", "127.0.0.1:19160"})
+	assert.Nil(t, err)
+	assert.Equal(t, 1, learned)
+	assert.True(t, hasContact(network, bootstrap.routing_table.me.ID), "Expected the bootstrap id to be learned")
+
+	_, err = network.JoinNetworkAny([]string{"127.0.0.1:19161"})
+	assert.ErrorIs(t, err, ErrBootstrapUnreachable)
+}
+
+// TestBootstrapFallback verifies that bootstrap nodes join each other, so that nodes that fell back to
+// a secondary bootstrap node while the primary was down end up in the same network as the primary.
+func TestBootstrapFallback(t *testing.T) {
+	primary_addr, secondary_addr := "127.0.0.1:19250", "127.0.0.1:19251"
+	bootstrap_addrs := []string{primary_addr, secondary_addr}
+	opts := RPCOptions{Timeout: 50 * time.Millisecond, Retries: 0}
+
+	secondary := NewNetwork("127.0.0.1", "19251", NewMemoryStore())
+	secondary.rpc_opts = opts
+	go secondary.Listen()
+	_, err := secondary.JoinNetworkAny(bootstrap_addrs)
+	assert.ErrorIs(t, err, ErrBootstrapUnreachable, "Expected the primary to be down")
+	assert.ErrorIs(t, err, ErrBootstrapIsSelf, "Expected the secondary to skip itself")
+
+	early := NewNetwork("127.0.0.1", "19252", NewMemoryStore())
+	early.rpc_opts = opts
+	go early.Listen()
+	_, err = early.JoinNetworkAny(bootstrap_addrs)
+	assert.NoError(t, err)
+
+	// The primary comes back and joins through the secondary
+	primary := NewNetwork("127.0.0.1", "19250", NewMemoryStore())
+	primary.rpc_opts = opts
+	go primary.Listen()
+	_, err = primary.JoinNetworkAny(bootstrap_addrs)
+	assert.NoError(t, err)
+
+	late := NewNetwork("127.0.0.1", "19253", NewMemoryStore())
+	late.rpc_opts = opts
+	go late.Listen()
+	_, err = late.JoinNetworkAny(bootstrap_addrs)
+	assert.NoError(t, err)
+	assert.True(t, hasContact(late, early.routing_table.me.ID), "Expected a node joining through the primary to find one that joined through the secondary")
+}
+
+// TestFindValueBinary verifies that a binary value is shown in base64 and written to a file byte for byte.
+func TestFindValueBinary(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19230", NewMemoryStore())
+	value := []byte{0x00, 0xff, '\n', 0x80}
+	key := GetValueID("binary")
+	network.data_store.Store(key, value)
+
+	assert.Regexp(t, "^Value \\(base64\\): AP8KgA==, expires in ", network.SendFindValue(key.String()))
+	assert.Regexp(t, "^Value \\(base64\\): AP8KgA==, expires in ", network.SendFindValueBase64(key.String()))
+
+	path := filepath.Join(t.TempDir(), "value")
+	assert.Regexp(t, "^Wrote 4 bytes to ", network.SendFindValueToFile(key.String(), path))
+	written, err := os.ReadFile(path)
+	assert.NoError(t, err)
+	assert.Equal(t, value, written)
+}
+
+// TestStoreReplacesTampered verifies that a receiver replaces a value that does not match its content-addressed key
+// with one that does, however it was sent, and never the other way around.
+func TestStoreReplacesTampered(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19231", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19232", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+
+	value := []byte("content")
+	key := GetDataID(value)
+	resp, err := n1.SendAndWait("127.0.0.1:19232", RPC_STORE, storeParams(key, []byte("tampered"), time.Minute, LOCAL_CAPABILITIES))
+	assert.NoError(t, err)
+	assert.Equal(t, RESP_STORE_OK, resp.Rpc)
+
+	resp, err = n1.SendAndWait("127.0.0.1:19232", RPC_STORE, storeParams(key, value, time.Minute, LOCAL_CAPABILITIES))
+	assert.NoError(t, err)
+	assert.Equal(t, RESP_STORE_OK, resp.Rpc, "Expected the matching value to replace the tampered one")
+	stored, _ := n2.data_store.GetEntry(key)
+	assert.Equal(t, value, stored)
+
+	resp, err = n1.SendAndWait("127.0.0.1:19232", RPC_STORE, storeParams(key, []byte("tampered"), time.Minute, LOCAL_CAPABILITIES))
+	assert.NoError(t, err)
+	assert.Equal(t, RESP_STORE_EXISTS, resp.Rpc)
+	stored, _ = n2.data_store.GetEntry(key)
+	assert.Equal(t, value, stored, "Expected a tampered value never to replace the matching one")
+}
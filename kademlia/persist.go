@@ -0,0 +1,150 @@
+package kademlia
+
+// This file contains the persistence of the node identity and routing table.
+// The node key (see LoadNodeKey) and a snapshot of the known contacts are saved to a data directory,
+// so that a restarted node keeps its place in the network. Saved contacts are
+// pinged on startup and only the ones that still answer with the same id are trusted.
+
+import (
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"sync"
+	"time"
+)
+
+const CONTACTS_FILE = "contacts.json"     // File in the data directory holding the contact snapshot
+const SNAPSHOT_INTERVAL = 5 * time.Minute // Default time between contact snapshots
+
+// A saved contact
+type contactRecord struct {
+	ID      string `json:"id"`
+	Address string `json:"address"`
+}
+
+// Write data to path through a temporary file, so that a crash never leaves a partial file behind.
+func writeFileAtomic(path string, data []byte) error {
+	tmp_path := path + ".tmp"
+	if err := os.WriteFile(tmp_path, data, 0644); err != nil {
+		return err
+	}
+	return os.Rename(tmp_path, path)
+}
+
+// Save every contact in the routing table to path.
+func (network *Network) SaveContacts(path string) error {
+	rt := network.routing_table
+	contacts := rt.FindClosestContacts(rt.me.ID, rt.Len())
+	records := make([]contactRecord, len(contacts))
+	for i, c := range contacts {
+		records[i] = contactRecord{c.ID.String(), c.Address}
+	}
+	data, err := json.Marshal(records)
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Returns the contacts saved at path by SaveContacts, or none if nothing has been saved yet.
+func LoadContacts(path string) ([]Contact, error) {
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return nil, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	var records []contactRecord
+	if err := json.Unmarshal(data, &records); err != nil {
+		return nil, err
+	}
+	contacts := make([]Contact, 0, len(records))
+	for _, r := range records {
+		id, err := ParseKademliaID(r.ID)
+		if err != nil {
+			fmt.Printf("Persist: Skipping saved contact %s: %v\n", r.Address, err)
+			continue
+		}
+		contacts = append(contacts, NewContact(id, r.Address))
+	}
+	return contacts, nil
+}
+
+// Ping the saved contacts in parallel and add the ones that answer with the same id to the routing table.
+// Returns the number of contacts restored.
+func (network *Network) RestoreContacts(ctx context.Context, contacts []Contact) int {
+	restored := 0
+	var lock sync.Mutex
+	var wg sync.WaitGroup
+	for _, c := range contacts {
+		if c.ID.Equals(network.routing_table.me.ID) {
+			continue
+		}
+		wg.Add(1)
+		go func(c Contact) {
+			defer wg.Done()
+			var params = make(byte_arr_list, 1)
+			params[0] = []byte(c.ID.String())
+			resp, err := network.SendAndWaitContext(ctx, c.Address, RPC_PING, params, network.ping_opts)
+			if err != nil || resp.Rpc != RESP_PING_OK || resp.Src_node_id != c.ID.String() {
+				fmt.Printf("Persist: Saved contact %s did not answer, dropping it\n", c.String())
+				return
+			}
+			network.AddContact(c)
+			lock.Lock()
+			restored++
+			lock.Unlock()
+		}(c)
+	}
+	wg.Wait()
+	return restored
+}
+
+// Save the contacts to path in the background every interval, and once more when stopped.
+// A snapshotter that is already running is stopped first.
+func (network *Network) StartContactSnapshots(path string, interval time.Duration) {
+	network.StopContactSnapshots()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	network.snapshot_lock.Lock()
+	network.snapshot_stop = stop
+	network.snapshot_done = done
+	network.snapshot_lock.Unlock()
+
+	save := func() {
+		if err := network.SaveContacts(path); err != nil {
+			fmt.Printf("Persist: Saving contacts failed: %v\n", err)
+		}
+	}
+	go func() {
+		defer close(done)
+		ticker := time.NewTicker(interval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				save()
+			case <-stop:
+				save()
+				return
+			}
+		}
+	}()
+}
+
+// Stop the background snapshotter after a last snapshot, does nothing if it is not running.
+func (network *Network) StopContactSnapshots() {
+	network.snapshot_lock.Lock()
+	stop, done := network.snapshot_stop, network.snapshot_done
+	network.snapshot_stop, network.snapshot_done = nil, nil
+	network.snapshot_lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
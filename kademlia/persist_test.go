@@ -0,0 +1,63 @@
+package kademlia
+
+import (
+	"context"
+	"path/filepath"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestLoadNodeKey verifies that a node key, and thus the node id, is created once and then reloaded.
+func TestLoadNodeKey(t *testing.T) {
+	dir := filepath.Join(t.TempDir(), "data")
+	key, err := LoadNodeKey(dir)
+	assert.NoError(t, err)
+	reloaded, err := LoadNodeKey(dir)
+	assert.NoError(t, err)
+	assert.True(t, key.Equal(reloaded))
+}
+
+// TestSaveContacts verifies that a contact snapshot is loaded back as it was saved.
+func TestSaveContacts(t *testing.T) {
+	path := filepath.Join(t.TempDir(), CONTACTS_FILE)
+	network := NewNetwork("127.0.0.1", "19190", NewMemoryStore())
+	c1 := NewContact(NewRandomKademliaID(), "127.0.0.1:19191")
+	c2 := NewContact(NewRandomKademliaID(), "127.0.0.1:19192")
+	network.routing_table.AddContact(c1)
+	network.routing_table.AddContact(c2)
+
+	assert.NoError(t, network.SaveContacts(path))
+	contacts, err := LoadContacts(path)
+	assert.NoError(t, err)
+	assert.Len(t, contacts, 2)
+	for _, c := range contacts {
+		assert.True(t, c.ID.Equals(c1.ID) && c.Address == c1.Address || c.ID.Equals(c2.ID) && c.Address == c2.Address)
+	}
+
+	missing, err := LoadContacts(filepath.Join(t.TempDir(), CONTACTS_FILE))
+	assert.NoError(t, err)
+	assert.Empty(t, missing)
+}
+
+// TestRestoreContacts verifies that only saved contacts that still answer with the same id are trusted.
+func TestRestoreContacts(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19193", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19194", NewMemoryStore())
+	n3 := NewNetwork("127.0.0.1", "19195", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	go n3.Listen()
+	n1.ping_opts = RPCOptions{Timeout: 50 * time.Millisecond, Retries: 0}
+
+	gone := NewContact(NewRandomKademliaID(), "127.0.0.1:19196")
+	// n3 restarted with a new id at the saved address
+	replaced := NewContact(NewRandomKademliaID(), "127.0.0.1:19195")
+	saved := []Contact{n2.routing_table.me, gone, replaced}
+
+	assert.Equal(t, 1, n1.RestoreContacts(context.Background(), saved))
+	assert.True(t, hasContact(n1, n2.routing_table.me.ID))
+	assert.False(t, hasContact(n1, gone.ID))
+	assert.False(t, hasContact(n1, replaced.ID))
+}
@@ -0,0 +1,89 @@
+package kademlia
+
+// This file contains the periodic bucket refresh from the kademlia paper.
+// Any bucket that has not seen a node lookup in its range within the refresh
+// interval is refreshed by looking up a random id in that range.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const BUCKET_REFRESH_INTERVAL = time.Hour // Default max time without a lookup before a bucket is refreshed
+const MIN_CHECK_PERIOD = time.Millisecond // Shortest period between checks of the background refresher and republisher
+
+// The period of a background task that checks a few times per interval, at least MIN_CHECK_PERIOD.
+func checkPeriod(interval time.Duration) time.Duration {
+	return max(interval/4, MIN_CHECK_PERIOD)
+}
+
+// Refresh every bucket that has not seen a lookup within max_age, returns the number of buckets refreshed.
+// As in the paper, buckets closer than the closest known node are skipped; a lookup there
+// would ask the same nodes as one in the closest non-empty bucket.
+func (network *Network) RefreshBuckets(ctx context.Context, max_age time.Duration) int {
+	closest := network.routing_table.ClosestBucket()
+	refreshed := 0
+	for _, index := range network.routing_table.StaleBuckets(max_age) {
+		if ctx.Err() != nil || index > closest {
+			break
+		}
+		refreshed++
+		target := network.routing_table.RandomIDInBucket(index)
+		// The lookup touches the bucket, even if nothing was found
+		_, err := network.NodeLookup(ctx, target)
+		if err != nil && err != ErrNoContacts {
+			fmt.Printf("Refresh: Lookup in bucket %d failed: %v\n", index, err)
+		}
+	}
+	return refreshed
+}
+
+// Start refreshing stale buckets in the background, checking a few times per interval.
+// A refresher that is already running is stopped first.
+func (network *Network) StartBucketRefresh(interval time.Duration) {
+	network.StopBucketRefresh()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	network.refresh_lock.Lock()
+	network.refresh_stop = stop
+	network.refresh_done = done
+	network.refresh_lock.Unlock()
+
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-stop
+			cancel()
+		}()
+
+		ticker := time.NewTicker(checkPeriod(interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := network.RefreshBuckets(ctx, interval); n > 0 {
+					fmt.Printf("Refresh: Refreshed %d buckets\n", n)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the background refresher and wait for it to finish, does nothing if it is not running.
+func (network *Network) StopBucketRefresh() {
+	network.refresh_lock.Lock()
+	stop, done := network.refresh_stop, network.refresh_done
+	network.refresh_stop, network.refresh_done = nil, nil
+	network.refresh_lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
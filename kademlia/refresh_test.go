@@ -0,0 +1,45 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestRefreshBuckets verifies that a refresh pass looks up every stale bucket up to the closest known node and learns about other nodes.
+func TestRefreshBuckets(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19140", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19141", NewMemoryStore())
+	n3 := NewNetwork("127.0.0.1", "19142", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	go n3.Listen()
+	n1.routing_table.AddContact(n2.routing_table.me)
+	n2.routing_table.AddContact(n3.routing_table.me)
+
+	time.Sleep(10 * time.Millisecond)
+	closest := n1.routing_table.getBucketIndex(n2.routing_table.me.ID)
+	refreshed := n1.RefreshBuckets(context.Background(), 5*time.Millisecond)
+	assert.Equal(t, closest+1, refreshed, "Expected only the buckets up to the closest known node to be refreshed")
+	for _, index := range n1.routing_table.StaleBuckets(time.Minute) {
+		assert.Greater(t, index, closest, "Expected every bucket up to the closest known node to be touched")
+	}
+	assert.True(t, hasContact(n1, n3.routing_table.me.ID), "Expected n3 to be learned through n2")
+}
+
+// TestBucketRefreshStops verifies that the background refresher can be stopped and restarted.
+func TestBucketRefreshStops(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19143", NewMemoryStore())
+	network.StartBucketRefresh(20 * time.Millisecond)
+	network.StartBucketRefresh(20 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	network.StopBucketRefresh()
+	network.StopBucketRefresh()
+	assert.Nil(t, network.refresh_stop)
+
+	// An interval too short to divide into checks must not panic
+	network.StartBucketRefresh(0)
+	network.StopBucketRefresh()
+}
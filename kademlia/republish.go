@@ -0,0 +1,145 @@
+package kademlia
+
+// This file contains the republishing of values from the kademlia paper.
+// The original publisher of a value stores it again before it expires, and every
+// node holding a value replicates it to the current k closest nodes on an interval,
+// unless it received the value via STORE within that interval. Values thus survive
+// the nodes holding them leaving the network.
+
+import (
+	"context"
+	"fmt"
+	"time"
+)
+
+const REPLICATE_INTERVAL = time.Hour      // Default max time without a STORE before a held value is replicated
+const REPUBLISH_INTERVAL = 12 * time.Hour // Default time between republishes of a value put by this node
+
+// A value put by this node, republished until the node stops
+type publishedValue struct {
+	value []byte
+	ttl   time.Duration
+	next  time.Time // Time of the next republish
+}
+
+// Time between republishes of a value with the given ttl, short enough that it never expires in between.
+func republishInterval(ttl time.Duration) time.Duration {
+	if ttl/2 < REPUBLISH_INTERVAL {
+		return ttl / 2
+	}
+	return REPUBLISH_INTERVAL
+}
+
+// Remember a value put by this node so that it is republished.
+func (network *Network) publish(key *KademliaID, value []byte, ttl time.Duration) {
+	network.publish_lock.Lock()
+	defer network.publish_lock.Unlock()
+	network.published[*key] = &publishedValue{value, ttl, time.Now().Add(republishInterval(ttl))}
+}
+
+// Stop republishing the value put under key. It expires from the network once its ttl has passed.
+func (network *Network) Unpublish(key *KademliaID) {
+	network.publish_lock.Lock()
+	defer network.publish_lock.Unlock()
+	delete(network.published, *key)
+}
+
+// Store every value put by this node that is due for a republish again, with its original ttl.
+// Returns the number of values republished.
+func (network *Network) RepublishValues(ctx context.Context) int {
+	now := time.Now()
+	due := make(map[KademliaID]publishedValue)
+	network.publish_lock.Lock()
+	for key, pv := range network.published {
+		if !now.Before(pv.next) {
+			due[key] = *pv
+			pv.next = now.Add(republishInterval(pv.ttl))
+		}
+	}
+	network.publish_lock.Unlock()
+
+	for key, pv := range due {
+		if ctx.Err() != nil {
+			break
+		}
+		key := key
+		if _, err := network.storeValue(ctx, &key, pv.value, pv.ttl); err != nil {
+			fmt.Printf("Republish: Storing %s failed: %v\n", key.String(), err)
+		}
+	}
+	return len(due)
+}
+
+// Replicate every held value that has not been received via STORE or replicated within max_age
+// to the k closest nodes to its key, with the time it has left to live.
+// Returns the number of values replicated.
+func (network *Network) ReplicateEntries(ctx context.Context, max_age time.Duration) int {
+	stale := network.data_store.StaleEntries(max_age)
+	for _, e := range stale {
+		if ctx.Err() != nil {
+			break
+		}
+		ttl := time.Until(e.expires)
+		if ttl <= 0 {
+			continue
+		}
+		_, err := network.storeValue(ctx, e.key, e.value, ttl)
+		if err != nil && err != ErrNoContacts {
+			fmt.Printf("Republish: Replicating %s failed: %v\n", e.key.String(), err)
+		}
+		network.data_store.TouchEntry(e.key)
+	}
+	return len(stale)
+}
+
+// Start republishing and replicating values in the background, checking a few times per replicate interval.
+// A republisher that is already running is stopped first.
+func (network *Network) StartRepublisher(replicate_interval time.Duration) {
+	network.StopRepublisher()
+
+	stop := make(chan struct{})
+	done := make(chan struct{})
+	network.repub_lock.Lock()
+	network.repub_stop = stop
+	network.repub_done = done
+	network.repub_lock.Unlock()
+
+	go func() {
+		defer close(done)
+		ctx, cancel := context.WithCancel(context.Background())
+		defer cancel()
+		go func() {
+			<-stop
+			cancel()
+		}()
+
+		ticker := time.NewTicker(checkPeriod(replicate_interval))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				if n := network.RepublishValues(ctx); n > 0 {
+					fmt.Printf("Republish: Republished %d values\n", n)
+				}
+				if n := network.ReplicateEntries(ctx, replicate_interval); n > 0 {
+					fmt.Printf("Republish: Replicated %d values\n", n)
+				}
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop the background republisher and wait for it to finish, does nothing if it is not running.
+func (network *Network) StopRepublisher() {
+	network.repub_lock.Lock()
+	stop, done := network.repub_stop, network.repub_done
+	network.repub_stop, network.repub_done = nil, nil
+	network.repub_lock.Unlock()
+
+	if stop != nil {
+		close(stop)
+		<-done
+	}
+}
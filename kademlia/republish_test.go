@@ -0,0 +1,68 @@
+package kademlia
+
+import (
+	"context"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestReplicateEntries verifies that a held value is replicated to the closest nodes,
+// and that neither the holder nor the receivers replicate it again within the interval.
+func TestReplicateEntries(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19170", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19171", NewMemoryStore())
+	n3 := NewNetwork("127.0.0.1", "19172", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	go n3.Listen()
+	n1.routing_table.AddContact(n2.routing_table.me)
+	n1.routing_table.AddContact(n3.routing_table.me)
+
+	key := GetValueID("replicated")
+	n1.data_store.StoreWithTTL(key, []byte("replicated"), time.Minute)
+	time.Sleep(10 * time.Millisecond)
+
+	assert.Equal(t, 1, n1.ReplicateEntries(context.Background(), 5*time.Millisecond))
+	assert.True(t, n2.data_store.EntryExists(key))
+	assert.True(t, n3.data_store.EntryExists(key))
+	ttl, _ := n2.data_store.GetTTL(key)
+	assert.True(t, ttl <= time.Minute, "Replication must not extend the life of a value")
+
+	assert.Equal(t, 0, n1.ReplicateEntries(context.Background(), time.Minute))
+	assert.Equal(t, 0, n2.ReplicateEntries(context.Background(), time.Minute))
+}
+
+// TestRepublishValues verifies that a value put by a node outlives its ttl while it is republished.
+func TestRepublishValues(t *testing.T) {
+	n1 := NewNetwork("127.0.0.1", "19173", NewMemoryStore())
+	n2 := NewNetwork("127.0.0.1", "19174", NewMemoryStore())
+	go n1.Listen()
+	go n2.Listen()
+	n1.routing_table.AddContact(n2.routing_table.me)
+
+	key := GetValueID("published")
+	_, err := n1.PutWithTTL(context.Background(), key, []byte("published"), 200*time.Millisecond)
+	assert.NoError(t, err)
+	assert.Equal(t, 0, n1.RepublishValues(context.Background()), "Value is not due yet")
+
+	time.Sleep(120 * time.Millisecond)
+	assert.Equal(t, 1, n1.RepublishValues(context.Background()))
+	time.Sleep(120 * time.Millisecond)
+	assert.True(t, n2.data_store.EntryExists(key), "Republished value expired")
+
+	n1.Unpublish(key)
+	assert.Equal(t, 0, n1.RepublishValues(context.Background()))
+}
+
+// TestRepublisherStops verifies that the background republisher can be stopped and restarted.
+func TestRepublisherStops(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19175", NewMemoryStore())
+	network.StartRepublisher(20 * time.Millisecond)
+	network.StartRepublisher(20 * time.Millisecond)
+	time.Sleep(50 * time.Millisecond)
+	network.StopRepublisher()
+	network.StopRepublisher()
+	assert.Nil(t, network.repub_stop)
+}
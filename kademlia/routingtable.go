@@ -1,10 +1,15 @@
 package kademlia
 
-const bucketSize = 20
+import "time"
 
+const bucketSize = 20
+const replacementCacheSize = 20 // Max contacts kept per bucket to replace stale ones
+const staleFailures = 2         // Failed RPCs in a row before a contact is considered stale
 
 // RoutingTable definition
-// keeps a refrence contact of me and an array of buckets
+// keeps a refrence contact of me and an array of buckets.
+// me and the bucket array never change after creation and every bucket has its own lock,
+// so a RoutingTable is safe for concurrent use.
 type RoutingTable struct {
 	me      Contact
 	buckets [IDLength * 8]*bucket
@@ -20,11 +25,27 @@ func NewRoutingTable(me Contact) *RoutingTable {
 	return routingTable
 }
 
-// AddContact add a new contact to the correct Bucket
-func (routingTable *RoutingTable) AddContact(contact Contact) {
+// AddContact add a new contact to the correct Bucket.
+// If the Bucket is full, its least-recently seen contact is returned (see bucket.AddContact)
+func (routingTable *RoutingTable) AddContact(contact Contact) *Contact {
 	bucketIndex := routingTable.getBucketIndex(contact.ID)
 	bucket := routingTable.buckets[bucketIndex]
-	bucket.AddContact(contact)
+	return bucket.AddContact(contact)
+}
+
+// RemoveContact removes a contact from its Bucket, promoting a replacement in its place
+func (routingTable *RoutingTable) RemoveContact(id *KademliaID) bool {
+	bucketIndex := routingTable.getBucketIndex(id)
+	bucket := routingTable.buckets[bucketIndex]
+	return bucket.RemoveContact(id)
+}
+
+// MarkFailed counts a failed RPC to a contact, see bucket.MarkFailed.
+// Returns true if the contact was stale and has been replaced
+func (routingTable *RoutingTable) MarkFailed(id *KademliaID) bool {
+	bucketIndex := routingTable.getBucketIndex(id)
+	bucket := routingTable.buckets[bucketIndex]
+	return bucket.MarkFailed(id)
 }
 
 // FindClosestContacts finds the count closest Contacts to the target in the RoutingTable
@@ -55,6 +76,57 @@ func (routingTable *RoutingTable) FindClosestContacts(target *KademliaID, count
 	return candidates.GetContacts(count)
 }
 
+// Len returns the number of contacts in all Buckets
+func (routingTable *RoutingTable) Len() int {
+	n := 0
+	for _, bucket := range routingTable.buckets {
+		n += bucket.Len()
+	}
+	return n
+}
+
+// TouchBucket records a lookup for id in the Bucket whose range it falls in
+func (routingTable *RoutingTable) TouchBucket(id *KademliaID) {
+	bucketIndex := routingTable.getBucketIndex(id)
+	routingTable.buckets[bucketIndex].Touch()
+}
+
+// StaleBuckets returns the indexes of the Buckets that have not seen a lookup within maxAge
+func (routingTable *RoutingTable) StaleBuckets(maxAge time.Duration) []int {
+	var stale []int
+	for i, bucket := range routingTable.buckets {
+		if time.Since(bucket.LastLookup()) >= maxAge {
+			stale = append(stale, i)
+		}
+	}
+	return stale
+}
+
+// ClosestBucket returns the index of the non-empty Bucket closest to me, or -1 if every Bucket is empty
+func (routingTable *RoutingTable) ClosestBucket() int {
+	for i := len(routingTable.buckets) - 1; i >= 0; i-- {
+		if routingTable.buckets[i].Len() > 0 {
+			return i
+		}
+	}
+	return -1
+}
+
+// RandomIDInBucket returns a random KademliaID that falls in the range of the Bucket at bucketIndex,
+// that is, whose distance to me has its first set bit at bucketIndex
+func (routingTable *RoutingTable) RandomIDInBucket(bucketIndex int) *KademliaID {
+	distance := NewRandomKademliaID()
+	for i := 0; i < IDLength*8; i++ {
+		mask := byte(0x80 >> uint(i%8))
+		if i < bucketIndex {
+			distance[i/8] &^= mask
+		} else if i == bucketIndex {
+			distance[i/8] |= mask
+		}
+	}
+	return routingTable.me.ID.CalcDistance(distance)
+}
+
 // getBucketIndex get the correct Bucket index for the KademliaID
 func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
 	distance := id.CalcDistance(routingTable.me.ID)
@@ -67,4 +139,4 @@ func (routingTable *RoutingTable) getBucketIndex(id *KademliaID) int {
 	}
 
 	return IDLength*8 - 1
-}
\ No newline at end of file
+}
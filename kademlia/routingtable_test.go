@@ -1,7 +1,10 @@
 package kademlia
 
 import (
+	"fmt"
+	"sync"
 	"testing"
+	"time"
 
 	"github.com/stretchr/testify/assert"
 )
@@ -69,3 +72,65 @@ func TestGetBucketIndex(t *testing.T) {
 	assert.GreaterOrEqual(t, index, 0, "Expected bucket index to be non-negative.")
 	assert.Less(t, index, IDLength*8, "Expected bucket index to be less than total number of buckets.")
 }
+
+// TestRoutingTableConcurrentAccess hammers the routing table with parallel adds, removes and lookups.
+// Run with -race to detect unsynchronised access.
+func TestRoutingTableConcurrentAccess(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), "localhost:8000"))
+
+	const workers = 8
+	const iterations = 500
+	var wg sync.WaitGroup
+	for w := 0; w < workers; w++ {
+		wg.Add(3)
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				rt.AddContact(NewContact(NewRandomKademliaID(), fmt.Sprintf("localhost:%d", 9000+i)))
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				contacts := rt.FindClosestContacts(NewRandomKademliaID(), PARAM_K)
+				assert.LessOrEqual(t, len(contacts), PARAM_K)
+			}
+		}()
+		go func() {
+			defer wg.Done()
+			for i := 0; i < iterations; i++ {
+				for _, c := range rt.FindClosestContacts(NewRandomKademliaID(), 1) {
+					rt.RemoveContact(c.ID)
+				}
+			}
+		}()
+	}
+	wg.Wait()
+
+	for _, b := range rt.buckets {
+		assert.LessOrEqual(t, b.Len(), bucketSize, "Expected no bucket to exceed its size")
+	}
+}
+
+// TestRandomIDInBucket verifies that generated ids fall in the range of the requested bucket.
+func TestRandomIDInBucket(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "localhost:8000"))
+	for _, index := range []int{0, 1, 7, 8, 42, 100, IDLength*8 - 1} {
+		id := rt.RandomIDInBucket(index)
+		assert.Equal(t, index, rt.getBucketIndex(id), "Expected id to fall in bucket %d", index)
+	}
+}
+
+// TestStaleBuckets verifies that buckets become stale without lookups and fresh after a touch.
+func TestStaleBuckets(t *testing.T) {
+	rt := NewRoutingTable(NewContact(NewRandomKademliaID(), "localhost:8000"))
+	assert.Empty(t, rt.StaleBuckets(time.Hour))
+
+	time.Sleep(10 * time.Millisecond)
+	assert.Equal(t, IDLength*8, len(rt.StaleBuckets(5*time.Millisecond)))
+
+	rt.TouchBucket(rt.RandomIDInBucket(3))
+	stale := rt.StaleBuckets(5 * time.Millisecond)
+	assert.Equal(t, IDLength*8-1, len(stale))
+	assert.NotContains(t, stale, 3)
+}
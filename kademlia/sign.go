@@ -0,0 +1,158 @@
+package kademlia
+
+// This file contains the signing of messages with the Ed25519 keypair of a node.
+// Every message carries the public key of its sender and a signature over the message,
+// and is dropped by the receiver before it touches the routing table unless:
+//   - the signature verifies with the public key, and
+//   - the public key belongs to Src_node_id; either the id is derived from the key
+//     (see NewKademliaIDFromPublicKey), or the message comes from a bootstrap address and it is the key
+//     first seen for that id, which is then pinned.
+// Nodes derive their id from their key, except bootstrap nodes with a configured id.
+// Any other sender could claim any id that is not derived, so those are only accepted from the addresses
+// this node joins through (see JoinNetworkAny), and at most MAX_PINNED_KEYS of them are pinned.
+// With RequireDerivedIDs only derived ids are accepted, which is the base of S/Kademlia style Sybil resistance.
+
+import (
+	"crypto/ed25519"
+	"crypto/rand"
+	"encoding/hex"
+	"errors"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+)
+
+const NODE_KEY_FILE = "node_key" // File in the data directory holding the private key seed
+const MAX_PINNED_KEYS = 64       // Most ids not derived from their key that are accepted, see above
+
+var (
+	ErrUnsigned      = errors.New("message is not signed")
+	ErrBadSignature  = errors.New("bad message signature")
+	ErrKeyMismatch   = errors.New("public key does not belong to the sender id")
+	ErrIDNotDerived  = errors.New("sender id is not derived from its public key")
+	ErrInvalidSender = errors.New("invalid sender id")
+)
+
+// Returns a new random Ed25519 key for a node.
+func GenerateNodeKey() ed25519.PrivateKey {
+	_, key, err := ed25519.GenerateKey(rand.Reader)
+	AssertAndCrash(err)
+	return key
+}
+
+// Returns the node key saved in dir, or a new key that is saved there first.
+func LoadNodeKey(dir string) (ed25519.PrivateKey, error) {
+	path := filepath.Join(dir, NODE_KEY_FILE)
+	data, err := os.ReadFile(path)
+	if err == nil {
+		seed, err := hex.DecodeString(strings.TrimSpace(string(data)))
+		if err != nil {
+			return nil, err
+		}
+		if len(seed) != ed25519.SeedSize {
+			return nil, fmt.Errorf("key in %s is not %d bytes long", path, ed25519.SeedSize)
+		}
+		return ed25519.NewKeyFromSeed(seed), nil
+	}
+	if !errors.Is(err, os.ErrNotExist) {
+		return nil, err
+	}
+
+	key := GenerateNodeKey()
+	if err := os.MkdirAll(dir, 0700); err != nil {
+		return nil, err
+	}
+	if err := writeFileAtomic(path, []byte(hex.EncodeToString(key.Seed())+"\n")); err != nil {
+		return nil, err
+	}
+	return key, nil
+}
+
+// The bytes covered by the signature; the encoded message without its signature, see wire.go.
+func (msg *NetworkMessage) signedBytes() ([]byte, error) {
+	unsigned := *msg
+	unsigned.Sig = nil
+	return unsigned.MarshalBinary()
+}
+
+// Set the public key and signature of the message.
+func (msg *NetworkMessage) Sign(key ed25519.PrivateKey) error {
+	msg.Pub = key.Public().(ed25519.PublicKey)
+	data, err := msg.signedBytes()
+	if err != nil {
+		return err
+	}
+	msg.Sig = ed25519.Sign(key, data)
+	return nil
+}
+
+// Returns nil if the message is signed by the public key it carries.
+// Whether that key belongs to the sender is checked by Network.verifySender.
+func (msg *NetworkMessage) VerifySignature() error {
+	if len(msg.Sig) == 0 || len(msg.Pub) == 0 {
+		return ErrUnsigned
+	}
+	if len(msg.Pub) != ed25519.PublicKeySize {
+		return ErrBadSignature
+	}
+	data, err := msg.signedBytes()
+	if err != nil || !ed25519.Verify(msg.Pub, data, msg.Sig) {
+		return ErrBadSignature
+	}
+	return nil
+}
+
+// Check that a message received from addr is signed by its sender, see above.
+// Pins the key of a bootstrap node seen for the first time.
+func (network *Network) verifyMessage(msg *NetworkMessage, addr string) (*KademliaID, error) {
+	if err := msg.VerifySignature(); err != nil {
+		return nil, err
+	}
+	src_id, err := ParseKademliaID(msg.Src_node_id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrInvalidSender, err)
+	}
+	if src_id.MatchesPublicKey(msg.Pub) {
+		return src_id, nil
+	}
+	if network.strict_ids {
+		return nil, ErrIDNotDerived
+	}
+
+	network.keys_lock.Lock()
+	defer network.keys_lock.Unlock()
+	if !network.bootstrap_addrs[addr] {
+		return nil, ErrIDNotDerived
+	}
+	pinned, ok := network.peer_keys[*src_id]
+	if !ok {
+		if len(network.peer_keys) >= MAX_PINNED_KEYS {
+			return nil, fmt.Errorf("%w: %d keys pinned already", ErrIDNotDerived, len(network.peer_keys))
+		}
+		network.peer_keys[*src_id] = append(ed25519.PublicKey(nil), msg.Pub...)
+		return src_id, nil
+	}
+	if !pinned.Equal(ed25519.PublicKey(msg.Pub)) {
+		return nil, ErrKeyMismatch
+	}
+	return src_id, nil
+}
+
+// Accept ids that are not derived from their key in messages from the bootstrap node at addr, see above.
+func (network *Network) trustBootstrap(addr string) {
+	resolved, err := net.ResolveUDPAddr("udp", addr)
+	if err != nil {
+		fmt.Printf("Could not resolve bootstrap node %s: %v\n", addr, err)
+		return
+	}
+	network.keys_lock.Lock()
+	network.bootstrap_addrs[resolved.String()] = true
+	network.keys_lock.Unlock()
+}
+
+// Only accept messages from senders whose id is derived from their public key.
+func (network *Network) RequireDerivedIDs(require bool) {
+	network.strict_ids = require
+}
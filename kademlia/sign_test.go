@@ -0,0 +1,103 @@
+package kademlia
+
+import (
+	"crypto/ed25519"
+	"net"
+	"testing"
+	"time"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// TestSignedMessage verifies that a signature covers the whole message.
+func TestSignedMessage(t *testing.T) {
+	key := GenerateNodeKey()
+	id := NewKademliaIDFromPublicKey(key.Public().(ed25519.PublicKey))
+	msg := NewNetworkMessage(RPC_PING, id, 1, GenerateRandomAuthID(), byte_arr_list{[]byte("data")})
+	assert.ErrorIs(t, msg.VerifySignature(), ErrUnsigned)
+
+	msg.Sign(key)
+	assert.NoError(t, msg.VerifySignature())
+
+	msg.Data[0] = []byte("tampered")
+	assert.ErrorIs(t, msg.VerifySignature(), ErrBadSignature)
+}
+
+// TestVerifySender verifies that derived ids are accepted from anyone, and that the first key seen for
+// any other id is pinned, but only for bootstrap addresses and up to MAX_PINNED_KEYS.
+func TestVerifySender(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19200", NewMemoryStore())
+	key := GenerateNodeKey()
+	derived := NewKademliaIDFromPublicKey(key.Public().(ed25519.PublicKey))
+	configured := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+	bootstrap, other := "127.0.0.1:19203", "127.0.0.1:19204"
+	network.trustBootstrap(bootstrap)
+
+	signed := func(id *KademliaID, key ed25519.PrivateKey) *NetworkMessage {
+		msg := NewNetworkMessage(RPC_PING, id, 1, GenerateRandomAuthID(), nil)
+		msg.Sign(key)
+		return msg
+	}
+
+	_, err := network.verifyMessage(signed(derived, key), other)
+	assert.NoError(t, err)
+	_, err = network.verifyMessage(signed(configured, key), other)
+	assert.ErrorIs(t, err, ErrIDNotDerived, "Expected an id that is not derived to be rejected from other addresses")
+	_, err = network.verifyMessage(signed(configured, key), bootstrap)
+	assert.NoError(t, err, "Expected the first key for an id to be pinned")
+	_, err = network.verifyMessage(signed(configured, key), bootstrap)
+	assert.NoError(t, err)
+	_, err = network.verifyMessage(signed(configured, GenerateNodeKey()), bootstrap)
+	assert.ErrorIs(t, err, ErrKeyMismatch)
+
+	for len(network.peer_keys) < MAX_PINNED_KEYS {
+		_, err = network.verifyMessage(signed(NewRandomKademliaID(), key), bootstrap)
+		assert.NoError(t, err)
+	}
+	_, err = network.verifyMessage(signed(NewRandomKademliaID(), key), bootstrap)
+	assert.ErrorIs(t, err, ErrIDNotDerived, "Expected no more than MAX_PINNED_KEYS keys to be pinned")
+
+	network.RequireDerivedIDs(true)
+	_, err = network.verifyMessage(signed(derived, key), other)
+	assert.NoError(t, err)
+	_, err = network.verifyMessage(signed(configured, key), bootstrap)
+	assert.ErrorIs(t, err, ErrIDNotDerived)
+}
+
+// TestBootstrapKey verifies that a bootstrap node keeps the configured id with a given key, so that a restored key is used.
+func TestBootstrapKey(t *testing.T) {
+	t.Setenv("IS_BOOTSTRAP_NODE", "true")
+	t.Setenv("BOOTSTRAP_NODE_ID", "FFFFFFFF00000000000000000000000000000000")
+	dir := t.TempDir()
+	key, err := LoadNodeKey(dir)
+	assert.NoError(t, err)
+	network := NewNetworkWithKey(key, "127.0.0.1", "19205", NewMemoryStore())
+	assert.Equal(t, "ffffffff00000000000000000000000000000000", network.GetID())
+
+	restored, err := LoadNodeKey(dir)
+	assert.NoError(t, err)
+	assert.True(t, network.key.Equal(restored), "Expected the bootstrap node to use the saved key")
+}
+
+// TestUnsignedMessageDropped verifies that an unsigned request is neither answered nor added to the routing table.
+func TestUnsignedMessageDropped(t *testing.T) {
+	network := NewNetwork("127.0.0.1", "19201", NewMemoryStore())
+	go network.Listen()
+
+	conn, err := net.ListenPacket("udp", "127.0.0.1:19202")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	forged := NewRandomKademliaID()
+	msg := NewNetworkMessage(RPC_PING, forged, 19202, GenerateRandomAuthID(), byte_arr_list{[]byte(network.GetID())})
+	data, _ := msg.MarshalBinary()
+	addr, _ := net.ResolveUDPAddr("udp", "127.0.0.1:19201")
+	conn.WriteTo(data, addr)
+
+	conn.SetReadDeadline(time.Now().Add(200 * time.Millisecond))
+	_, _, err = conn.ReadFrom(make([]byte, MAX_PACKET_SIZE))
+	assert.Error(t, err, "Expected no response to an unsigned message")
+	assert.False(t, hasContact(network, forged))
+}
@@ -2,54 +2,59 @@ package kademlia
 
 // Necessary imports
 import (
-	"log"
+	"time"
 )
 
+const DEFAULT_VALUE_TTL = 24 * time.Hour // Time to live of a value stored without an explicit TTL
+const MAX_VALUE_TTL = DEFAULT_VALUE_TTL  // Longest time to live accepted from another node
+const STORE_SWEEP_INTERVAL = time.Minute // How often the sweeper removes expired entries
+
 type Entry struct {
-	key   *KademliaID
-	value string
+	key       *KademliaID
+	value     []byte
+	expires   time.Time
+	refreshed time.Time // Last time the entry was received via STORE or replicated by this node
+}
+
+// Returns true if the entry has expired at the given time
+func (entry *Entry) Expired(now time.Time) bool {
+	return !now.Before(entry.expires)
 }
 
-type Store struct {
-	entries []*Entry
+func (entry *Entry) Key() *KademliaID {
+	return entry.key
 }
 
-func NewStore() *Store {
-	var s []*Entry
-	return &Store{s}
+// The value of the entry, which must not be modified
+func (entry *Entry) Value() []byte {
+	return entry.value
 }
 
-func (store *Store) NewEntry(hash *KademliaID, value string) *Entry {
-	return &Entry{hash, value}
+func (entry *Entry) Expires() time.Time {
+	return entry.expires
 }
 
-func (store *Store) Store(hash *KademliaID, value string) bool {
-	for _, e := range store.entries {
-		if e.key.Equals(hash) {
-			log.Println("Value is already stored")
-			return false
-		}
-	}
-	ne := store.NewEntry(hash, value)
-	store.entries = append(store.entries, ne)
-	return true
+// Storage backend of the values held by a node.
+// Implementations must be safe for concurrent use; expiry is handled by DataStore on top of them.
+type Store interface {
+	// Insert the entry, replacing any entry with the same key
+	Put(entry Entry) error
+	// Returns the entry with the given key, expired or not
+	Get(key *KademliaID) (Entry, bool)
+	// Remove the entry with the given key, does nothing if there is none
+	Delete(key *KademliaID) error
+	// Call fn for every entry until it returns false. fn must not modify the store
+	Iterate(fn func(entry Entry) bool) error
+	Stats() StoreStats
 }
 
-func (store *Store) GetEntry(hash *KademliaID) (string, bool) {
-	for _, e := range store.entries {
-		if e.key.Equals(hash) {
-			return e.value, true
-		}
-	}
-	log.Println("Value is not stored")
-	return "", false
+// Size of a Store
+type StoreStats struct {
+	Entries int   // Number of entries, including expired ones not yet removed
+	Bytes   int64 // Total size of the values
 }
 
-func (store *Store) EntryExists(hash *KademliaID) bool {
-	for _, e := range store.entries {
-		if e.key.Equals(hash) {
-			return true
-		}
-	}
-	return false
+// In-memory DataStore, the default for a node.
+func NewStore() *DataStore {
+	return NewDataStore(NewMemoryStore())
 }
@@ -1,11 +1,18 @@
 package kademlia
 
-import "testing"
+import (
+	"bytes"
+	"encoding/binary"
+	"fmt"
+	"sync"
+	"testing"
+	"time"
+)
 
 func TestStore(t *testing.T) {
 	test_store := NewStore()
 	id := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
-	var_1 := "1"
+	var_1 := []byte("1")
 	success := test_store.Store(id, var_1)
 
 	if !success {
@@ -17,7 +24,7 @@ func TestStore(t *testing.T) {
 	}
 
 	ret_1, success := test_store.GetEntry(id)
-	if (ret_1 != var_1) || !success {
+	if !bytes.Equal(ret_1, var_1) || !success {
 		t.Error("Store is not finding the value")
 	}
 }
@@ -26,8 +33,8 @@ func TestGetEntry(t *testing.T) {
 	test_store := NewStore()
 	id := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
 	id2 := NewKademliaID("1111111100000000000000000000000000000000")
-	val_1 := "val1"
-	val_2 := "val2"
+	val_1 := []byte("val1")
+	val_2 := []byte("val2")
 
 	_, success := test_store.GetEntry(id)
 	if success {
@@ -39,7 +46,7 @@ func TestGetEntry(t *testing.T) {
 	if !success {
 		t.Error("GetEntry returns false after entry has been added")
 	}
-	if val_1 != ret_1 {
+	if !bytes.Equal(val_1, ret_1) {
 		t.Error("Values do not match")
 	}
 
@@ -50,7 +57,7 @@ func TestGetEntry(t *testing.T) {
 
 	test_store.Store(id2, val_2)
 	ret_2, _ := test_store.GetEntry(id2)
-	if (ret_2 == ret_1) || (ret_2 != val_2) {
+	if bytes.Equal(ret_2, ret_1) || !bytes.Equal(ret_2, val_2) {
 		t.Error("Value mismatch")
 	}
 }
@@ -65,7 +72,7 @@ func TestEntryExists(t *testing.T) {
 		t.Error("EntryExists returns success when entry has not been added")
 	}
 
-	test_store.Store(id, "")
+	test_store.Store(id, nil)
 	success = test_store.EntryExists(id)
 	if !success {
 		t.Error("EntryExists returns false after entry has been added")
@@ -79,21 +86,177 @@ func TestEntryExists(t *testing.T) {
 
 func TestNewEntry(t *testing.T) {
 	key := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
-	val := "test"
+	val := []byte("test")
 	test_entry := NewStore().NewEntry(key, val)
 
 	if test_entry.key != key {
 		t.Error("Key mismatch")
 	}
 
-	if test_entry.value != val {
+	if !bytes.Equal(test_entry.value, val) {
 		t.Error("Val mismatch")
 	}
 }
 
 func TestNewSto(t *testing.T) {
 	test_store := NewStore()
-	if len(test_store.entries) > 0 {
+	if test_store.Stats().Entries > 0 {
 		t.Error("Store is not initiated with an empty list")
 	}
 }
+
+func TestStoreWithTTLExpires(t *testing.T) {
+	test_store := NewStore()
+	id := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+
+	if !test_store.StoreWithTTL(id, []byte("val"), 20*time.Millisecond) {
+		t.Error("StoreWithTTL reports the value as stored in an empty store")
+	}
+	ttl, ok := test_store.GetTTL(id)
+	if !ok || ttl <= 0 || ttl > 20*time.Millisecond {
+		t.Errorf("Unexpected ttl %v", ttl)
+	}
+
+	time.Sleep(30 * time.Millisecond)
+	if test_store.EntryExists(id) {
+		t.Error("Expired value is still returned")
+	}
+	if _, ok := test_store.GetTTL(id); ok {
+		t.Error("GetTTL returns success for an expired value")
+	}
+	if !test_store.StoreWithTTL(id, []byte("val"), time.Minute) {
+		t.Error("An expired value can not be stored again")
+	}
+}
+
+func TestStoreAgainExtendsTTL(t *testing.T) {
+	test_store := NewStore()
+	id := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+
+	test_store.StoreWithTTL(id, []byte("val"), time.Minute)
+	if test_store.StoreWithTTL(id, []byte("val"), time.Hour) {
+		t.Error("Storing a value again reports it as new")
+	}
+	ttl, _ := test_store.GetTTL(id)
+	if ttl <= time.Minute {
+		t.Errorf("Expiry was not extended, ttl %v", ttl)
+	}
+
+	// A shorter ttl never shortens the expiry
+	test_store.StoreWithTTL(id, []byte("val"), time.Second)
+	ttl, _ = test_store.GetTTL(id)
+	if ttl <= time.Minute {
+		t.Errorf("Expiry was shortened, ttl %v", ttl)
+	}
+}
+
+func TestStoreSweeper(t *testing.T) {
+	test_store := NewStore()
+	test_store.StoreWithTTL(NewKademliaID("FFFFFFFF00000000000000000000000000000000"), []byte("short"), 10*time.Millisecond)
+	test_store.StoreWithTTL(NewKademliaID("1111111100000000000000000000000000000000"), []byte("long"), time.Hour)
+
+	test_store.StartSweeper(5 * time.Millisecond)
+	defer test_store.StopSweeper()
+
+	deadline := time.Now().Add(time.Second)
+	for time.Now().Before(deadline) {
+		if test_store.Stats().Entries == 1 {
+			return
+		}
+		time.Sleep(5 * time.Millisecond)
+	}
+	t.Error("Sweeper did not remove the expired entry")
+}
+
+func TestStaleEntries(t *testing.T) {
+	test_store := NewStore()
+	id := NewKademliaID("FFFFFFFF00000000000000000000000000000000")
+	test_store.Store(id, []byte("val"))
+
+	if len(test_store.StaleEntries(time.Minute)) != 0 {
+		t.Error("A value that was just stored is stale")
+	}
+	time.Sleep(10 * time.Millisecond)
+	stale := test_store.StaleEntries(5 * time.Millisecond)
+	if len(stale) != 1 || !stale[0].key.Equals(id) {
+		t.Error("Value that was not refreshed is not stale")
+	}
+
+	test_store.TouchEntry(id)
+	if len(test_store.StaleEntries(5*time.Millisecond)) != 0 {
+		t.Error("A touched value is still stale")
+	}
+}
+
+func TestStoreConcurrent(t *testing.T) {
+	test_store := NewStore()
+	var wg sync.WaitGroup
+	for i := 0; i < 8; i++ {
+		wg.Add(1)
+		go func(i int) {
+			defer wg.Done()
+			for j := 0; j < 100; j++ {
+				id := benchKey(i*100 + j)
+				test_store.Store(id, []byte("val"))
+				test_store.GetEntry(id)
+				test_store.EntryExists(id)
+			}
+			test_store.RemoveExpired()
+		}(i)
+	}
+	wg.Wait()
+
+	if n := test_store.Stats().Entries; n != 800 {
+		t.Errorf("Expected 800 entries, got %d", n)
+	}
+}
+
+// Key number i for the benchmarks
+func benchKey(i int) *KademliaID {
+	var id KademliaID
+	binary.BigEndian.PutUint64(id[IDLength-8:], uint64(i))
+	return &id
+}
+
+// Store holding n entries
+func benchStore(n int) *DataStore {
+	test_store := NewStore()
+	for i := 0; i < n; i++ {
+		test_store.Store(benchKey(i), []byte("val"))
+	}
+	return test_store
+}
+
+// Lookups take the same time regardless of the number of entries
+func BenchmarkStoreGetEntry(b *testing.B) {
+	for _, n := range []int{1000, 1000000} {
+		test_store := benchStore(n)
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				test_store.GetEntry(benchKey(i % n))
+			}
+		})
+	}
+}
+
+func BenchmarkStoreEntryExists(b *testing.B) {
+	for _, n := range []int{1000, 1000000} {
+		test_store := benchStore(n)
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				test_store.EntryExists(benchKey(i % n))
+			}
+		})
+	}
+}
+
+func BenchmarkStoreStore(b *testing.B) {
+	for _, n := range []int{1000, 1000000} {
+		test_store := benchStore(n)
+		b.Run(fmt.Sprintf("entries=%d", n), func(b *testing.B) {
+			for i := 0; i < b.N; i++ {
+				test_store.Store(benchKey(n+i), []byte("val"))
+			}
+		})
+	}
+}
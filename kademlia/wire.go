@@ -0,0 +1,286 @@
+package kademlia
+
+// This file contains the binary wire format of a NetworkMessage, version 2.
+// Version 2 is the first versioned protocol; no node ever sent versions 0 and 1, and earlier nodes
+// sent unsigned JSON that is not decoded, since it cannot pass the checks of sign.go anyway.
+// All integers are big endian. A message is laid out as:
+//
+//	offset  size  field
+//	0       1     protocol version (PROTOCOL_VERSION)
+//	1       2     capabilities of the sender, see CAP_*
+//	3       1     rpc code
+//	4       20    sender node id
+//	24      2     sender port
+//	26      20    auth id
+//	46      1     number of data fields n
+//	47      ...   n data fields, each a 2 byte length followed by that many bytes
+//	        1+32  public key of the sender, a 1 byte length followed by the key
+//	        1+64  signature, a 1 byte length followed by the signature (0 if unsigned)
+//
+// The signature covers every byte before it, encoded with a signature length of 0.
+// Every later version must start with the same 46 bytes, so that a node can answer a request
+// in a version it does not know with RESP_UNSUPPORTED_VERSION. A later node answers a peer in the
+// version the peer sent, see Network.peerVersion.
+//
+// A contact list (RESP_CONTACTS) is a single data field holding a 1 byte count followed by the contacts:
+//
+//	20      node id
+//	1       address type; 4 (IPv4), 6 (IPv6) or 0 (string)
+//	4/16+2  the IP and port for type 4 and 6, or
+//	1+len   a 1 byte length followed by the address for type 0, at most MAX_ADDRESS_LENGTH bytes
+//
+// A full list of PARAM_K contacts always fits in MAX_PACKET_SIZE, see MAX_CONTACTS_SIZE.
+//
+// The TTL of a value, the third data field of a STORE and the second of a RESP_VALFOUND, is the
+// time to live in milliseconds as a 4 byte unsigned integer. Receivers clamp it to MAX_VALUE_TTL.
+// It is only sent to nodes with CAP_VALUE_TTL, others use their default TTL.
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"math"
+	"net"
+	"strconv"
+	"time"
+)
+
+const PROTOCOL_VERSION byte = 2     // Version sent to peers that have not told us otherwise
+const MIN_PROTOCOL_VERSION byte = 2 // Oldest version decoded
+const VERSION_UNKNOWN byte = 0xFF   // Version of a contact that has not been heard from directly
+
+// Capabilities, a bitmap advertised in every message.
+const (
+	CAP_VALUE_TTL uint16 = 1 << 0 // Reads the TTL field of STORE and RESP_VALFOUND, see above
+
+	LOCAL_CAPABILITIES = CAP_VALUE_TTL // Capabilities of this node
+)
+
+const prefixSize = 1 + 2 + 1 + IDLength + 2 + 20
+const headerSize = prefixSize + 1
+const MAX_ADDRESS_LENGTH = 64                                         // Longest contact address that is not an IP and port
+const maxContactSize = IDLength + 1 + 1 + MAX_ADDRESS_LENGTH          // Largest encoded contact
+const MAX_CONTACTS_SIZE = 1 + PARAM_K*maxContactSize                  // Largest encoded list of PARAM_K contacts
+const maxSignatureSize = 1 + 32 + 1 + 64                              // Encoded public key and signature
+const MAX_DATA_SIZE = MAX_PACKET_SIZE - headerSize - maxSignatureSize // Room for data fields in one datagram
+
+var (
+	ErrMessageTooLarge    = errors.New("message does not fit in one datagram")
+	ErrMalformedMessage   = errors.New("malformed message")
+	ErrUnsupportedVersion = errors.New("unsupported protocol version")
+)
+
+// Reads the fields of an encoded message or contact list, recording the first error.
+type wireReader struct {
+	data []byte
+	err  error
+}
+
+func (r *wireReader) next(n int) []byte {
+	if r.err != nil {
+		return nil
+	}
+	if n > len(r.data) {
+		r.err = fmt.Errorf("%w: truncated", ErrMalformedMessage)
+		return nil
+	}
+	b := r.data[:n]
+	r.data = r.data[n:]
+	return b
+}
+
+func (r *wireReader) uint8() byte {
+	if b := r.next(1); b != nil {
+		return b[0]
+	}
+	return 0
+}
+
+func (r *wireReader) uint16() uint16 {
+	if b := r.next(2); b != nil {
+		return binary.BigEndian.Uint16(b)
+	}
+	return 0
+}
+
+// Returns a copy of the next n bytes, so that the result does not alias the read buffer
+func (r *wireReader) clone(n int) []byte {
+	b := r.next(n)
+	if b == nil {
+		return nil
+	}
+	return append([]byte{}, b...)
+}
+
+// Encode the message in the format of msg.Version, see above.
+func (msg *NetworkMessage) MarshalBinary() ([]byte, error) {
+	if msg.Version < MIN_PROTOCOL_VERSION || msg.Version > PROTOCOL_VERSION {
+		return nil, fmt.Errorf("%w: %d", ErrUnsupportedVersion, msg.Version)
+	}
+
+	src_id, err := ParseKademliaID(msg.Src_node_id)
+	if err != nil {
+		return nil, fmt.Errorf("%w: sender id: %v", ErrMalformedMessage, err)
+	}
+	aid, err := ParseAuthID(msg.Aid)
+	if err != nil {
+		return nil, fmt.Errorf("%w: %v", ErrMalformedMessage, err)
+	}
+	if msg.Src_port < 0 || msg.Src_port > math.MaxUint16 {
+		return nil, fmt.Errorf("%w: port %d", ErrMalformedMessage, msg.Src_port)
+	}
+	if len(msg.Data) > math.MaxUint8 || len(msg.Pub) > math.MaxUint8 || len(msg.Sig) > math.MaxUint8 {
+		return nil, fmt.Errorf("%w: too many fields or key too long", ErrMalformedMessage)
+	}
+
+	buf := make([]byte, 0, MAX_PACKET_SIZE)
+	buf = append(buf, msg.Version)
+	buf = binary.BigEndian.AppendUint16(buf, msg.Caps)
+	buf = append(buf, msg.Rpc)
+	buf = append(buf, src_id[:]...)
+	buf = binary.BigEndian.AppendUint16(buf, uint16(msg.Src_port))
+	buf = append(buf, aid.value[:]...)
+	buf = append(buf, byte(len(msg.Data)))
+	for _, field := range msg.Data {
+		if len(field) > math.MaxUint16 {
+			return nil, ErrMessageTooLarge
+		}
+		buf = binary.BigEndian.AppendUint16(buf, uint16(len(field)))
+		buf = append(buf, field...)
+	}
+	buf = append(buf, byte(len(msg.Pub)))
+	buf = append(buf, msg.Pub...)
+	buf = append(buf, byte(len(msg.Sig)))
+	buf = append(buf, msg.Sig...)
+	if len(buf) > MAX_PACKET_SIZE {
+		return nil, fmt.Errorf("%w: %d bytes", ErrMessageTooLarge, len(buf))
+	}
+	return buf, nil
+}
+
+// Decode a message in any version from MIN_PROTOCOL_VERSION to PROTOCOL_VERSION, see above.
+// A message of a later version fails with ErrUnsupportedVersion, leaving only the header
+// fields of the common prefix in msg, so that the request can be answered.
+func (msg *NetworkMessage) UnmarshalBinary(data []byte) error {
+	if len(data) > 0 && data[0] == '{' {
+		return fmt.Errorf("%w: unversioned JSON", ErrMalformedMessage)
+	}
+
+	r := wireReader{data: data}
+	var decoded NetworkMessage
+	decoded.Version = r.uint8()
+	if r.err == nil && decoded.Version < MIN_PROTOCOL_VERSION {
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, decoded.Version)
+	}
+	decoded.Caps = r.uint16()
+	decoded.Rpc = r.uint8()
+	var src_id KademliaID
+	copy(src_id[:], r.next(IDLength))
+	decoded.Src_port = int(r.uint16())
+	var aid AuthID
+	copy(aid.value[:], r.next(len(aid.value)))
+	if r.err == nil && decoded.Version > PROTOCOL_VERSION {
+		decoded.Src_node_id = src_id.String()
+		decoded.Aid = aid.String()
+		*msg = decoded
+		return fmt.Errorf("%w: %d", ErrUnsupportedVersion, decoded.Version)
+	}
+	n := int(r.uint8())
+	for i := 0; i < n && r.err == nil; i++ {
+		decoded.Data = append(decoded.Data, r.clone(int(r.uint16())))
+	}
+	decoded.Pub = r.clone(int(r.uint8()))
+	decoded.Sig = r.clone(int(r.uint8()))
+	if r.err != nil {
+		return r.err
+	}
+	if len(r.data) != 0 {
+		return fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(r.data))
+	}
+	decoded.Src_node_id = src_id.String()
+	decoded.Aid = aid.String()
+	*msg = decoded
+	return nil
+}
+
+// Encode contacts in the binary contact list format, see above.
+// Returns an error if there are more than PARAM_K contacts or an address is too long.
+func EncodeContacts(contacts []Contact) ([]byte, error) {
+	if len(contacts) > PARAM_K {
+		return nil, fmt.Errorf("%w: %d contacts", ErrMessageTooLarge, len(contacts))
+	}
+	buf := make([]byte, 0, 1+len(contacts)*maxContactSize)
+	buf = append(buf, byte(len(contacts)))
+	for _, c := range contacts {
+		buf = append(buf, c.ID[:]...)
+		host, port_str, err := net.SplitHostPort(c.Address)
+		ip := net.ParseIP(host)
+		port, port_err := strconv.ParseUint(port_str, 10, 16)
+		switch {
+		case err == nil && port_err == nil && ip.To4() != nil:
+			buf = append(buf, 4)
+			buf = append(buf, ip.To4()...)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+		case err == nil && port_err == nil && ip != nil:
+			buf = append(buf, 6)
+			buf = append(buf, ip.To16()...)
+			buf = binary.BigEndian.AppendUint16(buf, uint16(port))
+		case len(c.Address) <= MAX_ADDRESS_LENGTH:
+			buf = append(buf, 0, byte(len(c.Address)))
+			buf = append(buf, c.Address...)
+		default:
+			return nil, fmt.Errorf("%w: address %q is too long", ErrMalformedMessage, c.Address)
+		}
+	}
+	return buf, nil
+}
+
+// Decode a list of contacts in the binary contact list format, see above.
+func DecodeContacts(data []byte) ([]Contact, error) {
+	r := wireReader{data: data}
+	n := int(r.uint8())
+	contacts := make([]Contact, 0, n)
+	for i := 0; i < n && r.err == nil; i++ {
+		var id KademliaID
+		copy(id[:], r.next(IDLength))
+		var address string
+		switch kind := r.uint8(); kind {
+		case 4, 6:
+			size := net.IPv4len
+			if kind == 6 {
+				size = net.IPv6len
+			}
+			ip := net.IP(r.clone(size))
+			port := r.uint16()
+			address = net.JoinHostPort(ip.String(), strconv.Itoa(int(port)))
+		case 0:
+			address = string(r.next(int(r.uint8())))
+		default:
+			if r.err == nil {
+				r.err = fmt.Errorf("%w: address type %d", ErrMalformedMessage, kind)
+			}
+		}
+		contacts = append(contacts, NewContact(&id, address))
+	}
+	if r.err != nil {
+		return nil, r.err
+	}
+	if len(r.data) != 0 {
+		return nil, fmt.Errorf("%w: %d trailing bytes", ErrMalformedMessage, len(r.data))
+	}
+	return contacts, nil
+}
+
+// Encode a TTL in the wire format, see above. It is clamped to MAX_VALUE_TTL and rounded up to a millisecond.
+func EncodeTTL(ttl time.Duration) []byte {
+	ms := (min(ttl, MAX_VALUE_TTL) + time.Millisecond - 1) / time.Millisecond
+	return binary.BigEndian.AppendUint32(nil, uint32(max(ms, 0)))
+}
+
+// Returns the contacts in a RESP_CONTACTS response.
+func ResponseContacts(resp NetworkMessage) ([]Contact, error) {
+	if len(resp.Data) < 1 {
+		return nil, fmt.Errorf("%w: no contact list", ErrMalformedMessage)
+	}
+	return DecodeContacts(resp.Data[0])
+}
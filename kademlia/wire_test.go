@@ -0,0 +1,167 @@
+package kademlia
+
+import (
+	"strings"
+	"testing"
+
+	"github.com/stretchr/testify/assert"
+)
+
+// A list of encoded contacts can never outgrow the data fields of a message.
+const _ = uint(MAX_DATA_SIZE - 2 - MAX_CONTACTS_SIZE)
+
+// TestMessageRoundTrip verifies that a signed message decodes to what was encoded.
+func TestMessageRoundTrip(t *testing.T) {
+	msg := NewNetworkMessage(RPC_STORE, NewRandomKademliaID(), 8000, GenerateRandomAuthID(), byte_arr_list{[]byte("key"), {}, []byte("value")})
+	assert.NoError(t, msg.Sign(GenerateNodeKey()))
+	data, err := msg.MarshalBinary()
+	assert.NoError(t, err)
+
+	var decoded NetworkMessage
+	assert.NoError(t, decoded.UnmarshalBinary(data))
+	assert.Equal(t, msg.Rpc, decoded.Rpc)
+	assert.Equal(t, msg.Src_node_id, decoded.Src_node_id)
+	assert.Equal(t, msg.Src_port, decoded.Src_port)
+	assert.Equal(t, msg.Aid, decoded.Aid)
+	assert.Equal(t, msg.Data, decoded.Data)
+	assert.Equal(t, LOCAL_CAPABILITIES, decoded.Caps)
+	assert.NoError(t, decoded.VerifySignature())
+}
+
+// TestEarlierFormats verifies that versions before MIN_PROTOCOL_VERSION and unversioned JSON are neither encoded nor decoded.
+func TestEarlierFormats(t *testing.T) {
+	msg := NewNetworkMessage(RPC_PING, NewRandomKademliaID(), 8000, GenerateRandomAuthID(), byte_arr_list{[]byte("data")})
+	data, err := msg.MarshalBinary()
+	assert.NoError(t, err)
+	data[0] = MIN_PROTOCOL_VERSION - 1
+
+	var decoded NetworkMessage
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data), ErrUnsupportedVersion)
+	assert.ErrorIs(t, decoded.UnmarshalBinary([]byte(`{"rpc":1,"src_node_id":"","resp_port":8000}`)), ErrMalformedMessage)
+
+	msg.Version = MIN_PROTOCOL_VERSION - 1
+	_, err = msg.MarshalBinary()
+	assert.ErrorIs(t, err, ErrUnsupportedVersion)
+}
+
+// TestLaterVersion verifies that the header of a message in a later version is still decoded, so that it can be answered.
+func TestLaterVersion(t *testing.T) {
+	msg := NewNetworkMessage(RPC_PING, NewRandomKademliaID(), 8000, GenerateRandomAuthID(), byte_arr_list{[]byte("data")})
+	data, err := msg.MarshalBinary()
+	assert.NoError(t, err)
+	data[0] = PROTOCOL_VERSION + 1
+
+	var decoded NetworkMessage
+	assert.ErrorIs(t, decoded.UnmarshalBinary(data), ErrUnsupportedVersion)
+	assert.Equal(t, RPC_PING, decoded.Rpc)
+	assert.Equal(t, msg.Aid, decoded.Aid)
+	assert.Equal(t, msg.Src_node_id, decoded.Src_node_id)
+}
+
+// TestUnmarshalRejects verifies that other versions, truncated and oversized input are rejected.
+func TestUnmarshalRejects(t *testing.T) {
+	msg := NewNetworkMessage(RPC_PING, NewRandomKademliaID(), 8000, GenerateRandomAuthID(), byte_arr_list{[]byte("data")})
+	data, err := msg.MarshalBinary()
+	assert.NoError(t, err)
+
+	var decoded NetworkMessage
+	for i := 0; i < len(data); i++ {
+		assert.ErrorIs(t, decoded.UnmarshalBinary(data[:i]), ErrMalformedMessage, "Truncated to %d bytes", i)
+	}
+	assert.ErrorIs(t, decoded.UnmarshalBinary(append(data, 0)), ErrMalformedMessage)
+	assert.ErrorIs(t, decoded.UnmarshalBinary(append([]byte{0}, data[1:]...)), ErrUnsupportedVersion)
+
+	msg.Data = byte_arr_list{make([]byte, MAX_PACKET_SIZE)}
+	_, err = msg.MarshalBinary()
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+// TestContactsRoundTrip verifies that IPv4, IPv6 and other addresses survive encoding.
+func TestContactsRoundTrip(t *testing.T) {
+	contacts := []Contact{
+		NewContact(NewRandomKademliaID(), "127.0.0.1:8000"),
+		NewContact(NewRandomKademliaID(), "[2001:db8::1]:65535"),
+		NewContact(NewRandomKademliaID(), "kademlia-node-3:8000"),
+	}
+	data, err := EncodeContacts(contacts)
+	assert.NoError(t, err)
+	decoded, err := DecodeContacts(data)
+	assert.NoError(t, err)
+	assert.Len(t, decoded, len(contacts))
+	for i := range contacts {
+		assert.True(t, contacts[i].ID.Equals(decoded[i].ID))
+		assert.Equal(t, contacts[i].Address, decoded[i].Address)
+	}
+
+	_, err = EncodeContacts([]Contact{NewContact(NewRandomKademliaID(), strings.Repeat("a", MAX_ADDRESS_LENGTH+1))})
+	assert.Error(t, err)
+	_, err = EncodeContacts(make([]Contact, PARAM_K+1))
+	assert.ErrorIs(t, err, ErrMessageTooLarge)
+}
+
+// TestFullContactsFit verifies that a signed response with PARAM_K of the largest contacts fits in one datagram.
+func TestFullContactsFit(t *testing.T) {
+	var contacts []Contact
+	for i := 0; i < PARAM_K; i++ {
+		contacts = append(contacts, NewContact(NewRandomKademliaID(), strings.Repeat("a", MAX_ADDRESS_LENGTH)))
+	}
+	data, err := EncodeContacts(contacts)
+	assert.NoError(t, err)
+	assert.LessOrEqual(t, len(data), MAX_CONTACTS_SIZE)
+
+	msg := NewNetworkMessage(RESP_CONTACTS, NewRandomKademliaID(), 65535, GenerateRandomAuthID(), byte_arr_list{data})
+	assert.NoError(t, msg.Sign(GenerateNodeKey()))
+	_, err = msg.MarshalBinary()
+	assert.NoError(t, err)
+}
+
+func FuzzUnmarshalBinary(f *testing.F) {
+	msg := NewNetworkMessage(RPC_STORE, NewRandomKademliaID(), 8000, GenerateRandomAuthID(), byte_arr_list{[]byte("key"), []byte("value")})
+	msg.Sign(GenerateNodeKey())
+	data, _ := msg.MarshalBinary()
+	f.Add(data)
+	f.Add([]byte{PROTOCOL_VERSION})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		var msg NetworkMessage
+		if msg.UnmarshalBinary(data) != nil {
+			return
+		}
+		encoded, err := msg.MarshalBinary()
+		if err != nil {
+			t.Fatalf("Decoded message does not encode: %v", err)
+		}
+		var again NetworkMessage
+		if err := again.UnmarshalBinary(encoded); err != nil {
+			t.Fatalf("Encoded message does not decode: %v", err)
+		}
+		assert.Equal(t, msg, again)
+	})
+}
+
+func FuzzDecodeContacts(f *testing.F) {
+	data, _ := EncodeContacts([]Contact{
+		NewContact(NewRandomKademliaID(), "127.0.0.1:8000"),
+		NewContact(NewRandomKademliaID(), "[::1]:8000"),
+		NewContact(NewRandomKademliaID(), "node:8000"),
+	})
+	f.Add(data)
+	f.Add([]byte{0})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		contacts, err := DecodeContacts(data)
+		if err != nil {
+			return
+		}
+		encoded, err := EncodeContacts(contacts)
+		if err != nil {
+			t.Fatalf("Decoded contacts do not encode: %v", err)
+		}
+		again, err := DecodeContacts(encoded)
+		if err != nil {
+			t.Fatalf("Encoded contacts do not decode: %v", err)
+		}
+		assert.Equal(t, len(contacts), len(again))
+		for i := range contacts {
+			assert.Equal(t, contacts[i].Address, again[i].Address)
+		}
+	})
+}
@@ -1,31 +1,132 @@
 package main
 
 import (
+	"context"
 	"d7024e/kademlia"
+	"flag"
 	"fmt"
 	"os"
+	"os/signal"
+	"path/filepath"
 	"strconv"
+	"syscall"
+	"time"
 )
 
+var bootstrap_flag = flag.String("bootstrap", "", "comma separated list of bootstrap node addresses, overrides BOOTSTRAP_NODES")
+
+// Bootstrap addresses from the -bootstrap flag, the BOOTSTRAP_NODES env, or the default bootstrap-node service.
+func bootstrapAddresses() []string {
+	if *bootstrap_flag != "" {
+		return kademlia.ParseBootstrapList(*bootstrap_flag)
+	}
+	if env := os.Getenv("BOOTSTRAP_NODES"); env != "" {
+		return kademlia.ParseBootstrapList(env)
+	}
+	return []string{"bootstrap-node:" + os.Getenv("BOOTSTRAP_PORT")}
+}
+
+// Storage backend from the STORE_LOG env; an append-only log at that path,
+// in data_dir if only DATA_DIR is set, or in-memory if neither is.
+func storeBackend(data_dir string) kademlia.Store {
+	path := os.Getenv("STORE_LOG")
+	if path == "" && data_dir != "" {
+		path = filepath.Join(data_dir, "values.log")
+	}
+	if path == "" {
+		return kademlia.NewMemoryStore()
+	}
+	backend, err := kademlia.NewLogStore(path)
+	kademlia.AssertAndCrash(err)
+	fmt.Printf("Storing values in %s, %d entries recovered\n", path, backend.Stats().Entries)
+	return backend
+}
+
+// Interval from the env var name, e.g. "30m", or def if it is not set. Crashes if it is not a positive duration.
+func intervalEnv(name string, def time.Duration) time.Duration {
+	env := os.Getenv(name)
+	if env == "" {
+		return def
+	}
+	interval, err := time.ParseDuration(env)
+	kademlia.AssertAndCrash(err)
+	if interval <= 0 {
+		kademlia.AssertAndCrash(fmt.Errorf("%s must be a positive duration, got %q", name, env))
+	}
+	return interval
+}
+
 func main() {
+	flag.Parse()
+
 	port := os.Getenv("PORT")
 	if port == "" {
 		port = "8008"
 	}
-	net := kademlia.NewNetwork("0.0.0.0", port, 10_000)
-	go net.Listen()
-	go net.InitializeCLI()
-
 	is_bootstrap, err := strconv.ParseBool(os.Getenv("IS_BOOTSTRAP_NODE"))
 	kademlia.AssertAndCrash(err)
 
-	if !is_bootstrap {
-		fmt.Println("Attempting to join network...")
-		net.JoinNetwork("bootstrap-node:" + os.Getenv("BOOTSTRAP_PORT"))
+	// With a data directory the node keeps its key, and thus its id, and contacts across restarts.
+	// A bootstrap node keeps its key too, as peers have pinned it for the configured id
+	data_dir := os.Getenv("DATA_DIR")
+	var net *kademlia.Network
+	if data_dir != "" {
+		key, err := kademlia.LoadNodeKey(data_dir)
+		kademlia.AssertAndCrash(err)
+		net = kademlia.NewNetworkWithKey(key, "0.0.0.0", port, storeBackend(data_dir))
 	} else {
+		net = kademlia.NewNetwork("0.0.0.0", port, storeBackend(data_dir))
+	}
+	if strict, _ := strconv.ParseBool(os.Getenv("REQUIRE_DERIVED_IDS")); strict {
+		net.RequireDerivedIDs(true)
+	}
+	go net.Listen()
+	go net.InitializeCLI()
+
+	restored := 0
+	contacts_path := filepath.Join(data_dir, kademlia.CONTACTS_FILE)
+	if data_dir != "" {
+		saved, err := kademlia.LoadContacts(contacts_path)
+		if err != nil {
+			fmt.Printf("Could not load saved contacts: %v\n", err)
+		}
+		restored = net.RestoreContacts(context.Background(), saved)
+		fmt.Printf("Restored %d of %d saved contacts\n", restored, len(saved))
+		net.StartContactSnapshots(contacts_path, kademlia.SNAPSHOT_INTERVAL)
+	}
+
+	// Bootstrap nodes join through the other bootstrap nodes, skipping themselves,
+	// so that nodes that fell back to different bootstrap nodes still end up in one network
+	if is_bootstrap {
 		fmt.Printf("Running bootstrap node on port %s\n", port)
 	}
+	fmt.Println("Attempting to join network...")
+	learned, err := net.JoinNetworkAny(bootstrapAddresses())
+	switch {
+	case err == nil:
+		fmt.Printf("Joined network, learned %d contacts\n", learned)
+	case is_bootstrap:
+		fmt.Printf("No other bootstrap node reachable, waiting for nodes to join: %v\n", err)
+	case restored > 0:
+		fmt.Printf("Could not reach a bootstrap node, continuing with %d restored contacts: %v\n", restored, err)
+	default:
+		fmt.Printf("Could not join network: %v\n", err)
+	}
+
+	net.StartBucketRefresh(intervalEnv("REFRESH_INTERVAL", kademlia.BUCKET_REFRESH_INTERVAL))
+	net.StartStoreSweeper(kademlia.STORE_SWEEP_INTERVAL)
 
-	for {
+	replicate_interval := intervalEnv("REPLICATE_INTERVAL", kademlia.REPLICATE_INTERVAL)
+	if env := os.Getenv("STORE_QUORUM"); env != "" {
+		quorum, err := strconv.Atoi(env)
+		kademlia.AssertAndCrash(err)
+		net.SetStoreQuorum(quorum)
 	}
+	net.StartRepublisher(replicate_interval)
+
+	// Block without spinning a core until stopped, the network runs in its own goroutines
+	stop := make(chan os.Signal, 1)
+	signal.Notify(stop, os.Interrupt, syscall.SIGTERM)
+	<-stop
+	net.StopContactSnapshots()
 }
@@ -19,7 +19,7 @@ func TestMain(t *testing.T) {
     os.Exit(1)
 	})
 
-	test_network := kademlia.NewNetwork("127.0.0.1", "9000", 2_000)
+	test_network := kademlia.NewNetwork("127.0.0.1", "9000", kademlia.NewMemoryStore())
 
 	bootstrap_id := "FFFFFFFF00000000000000000000000000000000"
 	os.Setenv("PORT", "9001")
@@ -45,7 +45,7 @@ func TestMain(t *testing.T) {
 	var nodes [NR_NODES]*kademlia.Network
 
 	for i := 0; i < NR_NODES; i++ {
-		node := kademlia.NewNetwork("127.0.0.1", fmt.Sprintf("%d", port), 10_100 + i * 100)
+		node := kademlia.NewNetwork("127.0.0.1", fmt.Sprintf("%d", port), kademlia.NewMemoryStore())
 		go node.Listen()
 		// network.InitializeCLI()
 		node.JoinNetwork("127.0.0.1:" + os.Getenv("BOOTSTRAP_PORT"))
@@ -76,9 +76,9 @@ func TestMain(t *testing.T) {
   n1 := rand.Intn(NR_NODES)
 
   resp = kademlia.Trim(nodes[n1].SendStore(kademlia.GetValueID("key").String(), []byte("value")))
-  assert.Equal(t, "Value has been stored in the network", resp)
+  assert.Regexp(t, "^Value has been stored in the network at [0-9]+ of [0-9]+ nodes$", resp)
   resp = kademlia.Trim(nodes[n1].SendFindValue(kademlia.GetValueID("key").String()))
-  assert.Equal(t, "Value: value", resp)
+  assert.Regexp(t, "^Value: value, expires in ", resp)
 
 	fmt.Println("Done")
 }